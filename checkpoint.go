@@ -0,0 +1,110 @@
+package emissary
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// A CheckpointStore remembers when each emissary last ran successfully, so a
+// Scheduler can work out which runs it missed while it was down.
+type CheckpointStore interface {
+	// Returns the zero time if the emissary has never run
+	LastRun(name string) (time.Time, error)
+	SetLastRun(name string, t time.Time) error
+}
+
+// MemoryCheckpointStore keeps checkpoints in memory, so they only survive as
+// long as the process. Its zero value is ready to use.
+type MemoryCheckpointStore struct {
+	mu    sync.Mutex
+	times map[string]time.Time
+}
+
+func (m *MemoryCheckpointStore) LastRun(name string) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.times[name], nil
+}
+
+func (m *MemoryCheckpointStore) SetLastRun(name string, t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.times == nil {
+		m.times = make(map[string]time.Time)
+	}
+	m.times[name] = t
+	return nil
+}
+
+// FileCheckpointStore keeps checkpoints in a JSON file on the local disk. The
+// file is replaced atomically on every update, so a crash never leaves it
+// half written.
+type FileCheckpointStore struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func (f *FileCheckpointStore) LastRun(name string) (time.Time, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	times, err := f.read()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return times[name], nil
+}
+
+func (f *FileCheckpointStore) SetLastRun(name string, t time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	times, err := f.read()
+	if err != nil {
+		return err
+	}
+	times[name] = t
+
+	encoded, err := json.MarshalIndent(times, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.Path), filepath.Base(f.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(encoded)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.Path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (f *FileCheckpointStore) read() (map[string]time.Time, error) {
+	times := make(map[string]time.Time)
+
+	contents, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return times, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(contents, &times)
+	return times, err
+}
@@ -0,0 +1,39 @@
+package emissary
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileCheckpointStore(t *testing.T) {
+	Convey("FileCheckpointStore", t, func() {
+		dir, err := ioutil.TempDir("", "emissary-checkpoints")
+		So(err, ShouldEqual, nil)
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "checkpoints.json")
+		store := &FileCheckpointStore{Path: path}
+
+		last, err := store.LastRun("census")
+		So(err, ShouldEqual, nil)
+		So(last.IsZero(), ShouldEqual, true)
+
+		ran := time.Date(2015, 4, 7, 2, 0, 0, 0, time.UTC)
+		So(store.SetLastRun("census", ran), ShouldEqual, nil)
+		So(store.SetLastRun("eligibility", ran.Add(time.Hour)), ShouldEqual, nil)
+
+		// A fresh store reads back what the first one wrote
+		reopened := &FileCheckpointStore{Path: path}
+		last, err = reopened.LastRun("census")
+		So(err, ShouldEqual, nil)
+		So(last.Equal(ran), ShouldEqual, true)
+
+		last, err = reopened.LastRun("eligibility")
+		So(err, ShouldEqual, nil)
+		So(last.Equal(ran.Add(time.Hour)), ShouldEqual, true)
+	})
+}
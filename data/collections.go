@@ -0,0 +1,293 @@
+package data
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// COLLECTION FUNCTIONS
+//
+// These take the list first. A list is any slice or array, usually of maps
+// (e.g. the []interface{} of map[string]interface{} in a decoded JSON
+// source), and a missing list is an empty one. Fields of the items are
+// named with dots, e.g. "address.state".
+
+func toList(arg interface{}) ([]interface{}, error) {
+	if arg == nil {
+		return nil, nil
+	}
+	if list, ok := arg.([]interface{}); ok {
+		return list, nil
+	}
+	value := reflect.ValueOf(arg)
+	if value.Kind() != reflect.Slice && value.Kind() != reflect.Array {
+		return nil, errors.New("Expected a list, got " + toString(arg))
+	}
+	list := make([]interface{}, value.Len())
+	for i := range list {
+		list[i] = value.Index(i).Interface()
+	}
+	return list, nil
+}
+
+// Gets an item of a map, slice or struct, or nil if there isn't one. Negative
+// indexes count from the end of a slice.
+func item(coll interface{}, key interface{}) (interface{}, error) {
+	if mp, ok := coll.(map[string]interface{}); ok {
+		return mp[toString(key)], nil
+	}
+
+	value := reflect.ValueOf(coll)
+	for value.Kind() == reflect.Interface || value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return nil, nil
+		}
+		value = value.Elem()
+	}
+
+	switch value.Kind() {
+	case reflect.Slice, reflect.Array, reflect.String:
+		i, err := toInt(key)
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 {
+			i += value.Len()
+		}
+		if i < 0 || i >= value.Len() {
+			return nil, nil
+		}
+		return value.Index(i).Interface(), nil
+	case reflect.Map:
+		keyType := value.Type().Key()
+		k := reflect.ValueOf(key)
+		if keyType.Kind() == reflect.String {
+			k = reflect.ValueOf(toString(key))
+		}
+		if !k.IsValid() || !k.Type().ConvertibleTo(keyType) {
+			return nil, nil
+		}
+		found := value.MapIndex(k.Convert(keyType))
+		if !found.IsValid() {
+			return nil, nil
+		}
+		return found.Interface(), nil
+	case reflect.Struct:
+		found := value.FieldByName(toString(key))
+		if !found.IsValid() || !found.CanInterface() {
+			return nil, nil
+		}
+		return found.Interface(), nil
+	case reflect.Invalid:
+		return nil, nil
+	}
+	return nil, errors.New("Can't index " + toString(coll))
+}
+
+// Gets a field by its dotted path, or nil if it's missing
+func field(arg interface{}, path string) interface{} {
+	for _, name := range strings.Split(path, ".") {
+		var err error
+		arg, err = item(arg, name)
+		if err != nil || arg == nil {
+			return nil
+		}
+	}
+	return arg
+}
+
+func first(arg interface{}) (interface{}, error) {
+	return at(arg, 0)
+}
+
+func last(arg interface{}) (interface{}, error) {
+	return at(arg, -1)
+}
+
+// at is like the template engine's index, but an index that's out of range
+// or a key that's missing is nil instead of an error, and negative indexes
+// count from the end
+func at(coll interface{}, keys ...interface{}) (interface{}, error) {
+	var err error
+	for _, key := range keys {
+		coll, err = item(coll, key)
+		if err != nil || coll == nil {
+			return nil, err
+		}
+	}
+	return coll, nil
+}
+
+// The number of items, or with a field and a value, the number of items
+// whose field is that value
+func count(arg interface{}, where ...interface{}) (int, error) {
+	if len(where) == 0 {
+		list, err := toList(arg)
+		return len(list), err
+	} else if len(where) != 2 {
+		return 0, errors.New("count requires a list, or a list, a field and a value")
+	}
+	list, err := filter(arg, toString(where[0]), "eq", where[1])
+	return len(list), err
+}
+
+// The items whose field is the value
+func where(arg interface{}, path string, value interface{}) ([]interface{}, error) {
+	return filter(arg, path, "eq", value)
+}
+
+var comparators = map[string]func(interface{}, interface{}) (bool, error){
+	"eq": func(arg1 interface{}, arg2 interface{}) (bool, error) {
+		return eq(arg1, arg2)
+	},
+	"neq": neq,
+	"lt":  lt,
+	"lte": lte,
+	"gt":  gt,
+	"gte": gte,
+}
+
+// The items whose field compares with the value, using one of the comparators
+// (e.g. "gte"). Items that don't have the field are left out.
+func filter(arg interface{}, path string, comparator string, value interface{}) ([]interface{}, error) {
+	compare, ok := comparators[comparator]
+	if !ok {
+		return nil, errors.New("Unknown comparator " + comparator)
+	}
+	list, err := toList(arg)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := []interface{}{}
+	for _, it := range list {
+		val := field(it, path)
+		if val == nil {
+			continue
+		}
+		match, err := compare(val, value)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			matches = append(matches, it)
+		}
+	}
+	return matches, nil
+}
+
+// The field of every item
+func pluck(arg interface{}, path string) ([]interface{}, error) {
+	list, err := toList(arg)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(list))
+	for i, it := range list {
+		values[i] = field(it, path)
+	}
+	return values, nil
+}
+
+// Adds up the items, or a field of each item. Missing values, and values that
+// aren't numbers, count as zero.
+func sum(arg interface{}, path ...string) (Decimal, error) {
+	list, err := toList(arg)
+	if err != nil {
+		return Decimal{}, err
+	}
+	total := Decimal{}
+	for _, it := range list {
+		if len(path) > 0 {
+			it = field(it, path[0])
+		}
+		total = total.Add(toDecimalOrZero(it))
+	}
+	return total, nil
+}
+
+// A copy of the list sorted by a field, in "asc" (the default) or "desc"
+// order. Items that don't have the field come first, or last in "desc" order.
+func sortBy(arg interface{}, path string, order ...string) ([]interface{}, error) {
+	list, err := toList(arg)
+	if err != nil {
+		return nil, err
+	}
+	desc := false
+	if len(order) > 0 {
+		switch order[0] {
+		case "asc":
+		case "desc":
+			desc = true
+		default:
+			return nil, errors.New("Unknown sort order " + order[0])
+		}
+	}
+
+	sorted := append([]interface{}(nil), list...)
+	var sortErr error
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := field(sorted[i], path), field(sorted[j], path)
+		if desc {
+			a, b = b, a
+		}
+		if a == nil || b == nil {
+			return a == nil && b != nil
+		}
+		less, err := lt(a, b)
+		if err != nil && sortErr == nil {
+			sortErr = err
+		}
+		return less
+	})
+	if sortErr != nil {
+		return nil, sortErr
+	}
+	return sorted, nil
+}
+
+// The list without repeats, which are items that look the same as one before
+// them
+func uniq(arg interface{}) ([]interface{}, error) {
+	list, err := toList(arg)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	unique := []interface{}{}
+	for _, it := range list {
+		key := toString(it)
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, it)
+		}
+	}
+	return unique, nil
+}
+
+// Lookup tables by name, each of which maps keys to values, e.g. internal
+// plan IDs to carrier plan codes. Values can be maps, so
+// {{(lookup "plans" .planId).carrierCode}} works.
+type Lookups map[string]map[string]interface{}
+
+// lookup table key [default], which is the default (or nil) if the table
+// doesn't have the key. Keys are compared as strings.
+func (l Lookups) lookup(args ...interface{}) (interface{}, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return nil, errors.New("lookup requires a table, a key and optionally a default")
+	}
+	name := toString(args[0])
+	table, ok := l[name]
+	if !ok {
+		return nil, errors.New("Unknown lookup table " + name)
+	}
+	if val, ok := table[toString(args[1])]; ok {
+		return val, nil
+	}
+	if len(args) == 3 {
+		return args[2], nil
+	}
+	return nil, nil
+}
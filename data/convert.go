@@ -0,0 +1,303 @@
+package data
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Converter turns structs into maps, which is what SetSource does with
+// them. The rules are:
+//
+// Fields are named by the first of TagNames that the field has, or else by
+// their Go name. Fields that tag says are "-" are left out, and so are
+// unexported fields and fields with the omitempty option that are empty.
+// Embedded structs' fields are promoted, as with encoding/json, unless the
+// tag names the embedded struct.
+//
+// Times, Decimals and GetTimes are kept as they are. Other
+// encoding.TextMarshalers become their text, and fmt.Stringers become
+// strings. Structs become maps, slices and arrays (other than []byte) become
+// []interface{}, and maps become map[string]interface{}, all converted the
+// same way. Pointers and interfaces are followed, and nil is nil. Anything
+// else is kept as it is.
+//
+// What the rules say about each type is worked out once and cached, so
+// converting lots of structs of the same type is fast.
+type Converter struct {
+	TagNames []string
+}
+
+// NewConverter returns a converter that names fields with the given tags,
+// in order
+func NewConverter(tagNames ...string) *Converter {
+	return &Converter{tagNames}
+}
+
+// Map converts a struct, or a pointer to one. Returns a *SourceError if src
+// is anything else.
+func (c *Converter) Map(src interface{}) (map[string]interface{}, error) {
+	value := reflect.ValueOf(src)
+	for value.Kind() == reflect.Ptr && !value.IsNil() {
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return nil, &SourceError{value.Kind()}
+	}
+	mp, err := c.convert(value)
+	if err != nil {
+		return nil, err
+	}
+	return mp.(map[string]interface{}), nil
+}
+
+// Convert converts any value by the converter's rules
+func (c *Converter) Convert(src interface{}) (interface{}, error) {
+	return c.convert(reflect.ValueOf(src))
+}
+
+// What to do with a type
+const (
+	convertAsIs = iota
+	convertText
+	convertString
+	convertFollow
+	convertStruct
+	convertList
+	convertMap
+)
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	decimalType       = reflect.TypeOf(Decimal{})
+	getTimeType       = reflect.TypeOf((*GetTime)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	stringerType      = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+)
+
+type typeInfo struct {
+	how    int
+	fields []fieldInfo
+}
+
+type fieldInfo struct {
+	// For reflect.Value.FieldByIndex, through any embedded structs
+	index     []int
+	name      string
+	omitEmpty bool
+}
+
+type typeKey struct {
+	t    reflect.Type
+	tags string
+}
+
+// typeKey to *typeInfo
+var typeCache sync.Map
+
+func (c *Converter) info(t reflect.Type) *typeInfo {
+	key := typeKey{t, strings.Join(c.TagNames, ",")}
+	if info, ok := typeCache.Load(key); ok {
+		return info.(*typeInfo)
+	}
+
+	info := &typeInfo{how: convertAsIs}
+	switch {
+	case t.Kind() == reflect.Interface:
+		info.how = convertFollow
+	case t == timeType || t == decimalType || t.Implements(getTimeType):
+	case t.Kind() == reflect.Ptr && !pointerOnly(t, textMarshalerType) && !pointerOnly(t, stringerType):
+		// Pointers are followed before anything else, so *time.Time stays
+		// a time
+		info.how = convertFollow
+	case t.Implements(textMarshalerType):
+		info.how = convertText
+	case t.Implements(stringerType):
+		info.how = convertString
+	case t.Kind() == reflect.Struct:
+		info.how = convertStruct
+		info.fields = c.fields(t, nil)
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		info.how = convertList
+	case t.Kind() == reflect.Map:
+		info.how = convertMap
+	}
+
+	typeCache.Store(key, info)
+	return info
+}
+
+// Whether a pointer type has the interface's methods only because they take a
+// pointer receiver, so following the pointer would lose them
+func pointerOnly(t reflect.Type, iface reflect.Type) bool {
+	return t.Implements(iface) && !t.Elem().Implements(iface)
+}
+
+// Reads the first of the converter's tags that the field has
+func (c *Converter) tag(field reflect.StructField) (name string, omitEmpty bool, skip bool, named bool) {
+	for _, tagName := range c.TagNames {
+		tag, ok := field.Tag.Lookup(tagName)
+		if !ok {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		if parts[0] == "-" && len(parts) == 1 {
+			return "", false, true, false
+		}
+		for _, option := range parts[1:] {
+			if option == "omitempty" {
+				omitEmpty = true
+			}
+		}
+		if len(parts[0]) > 0 {
+			return parts[0], omitEmpty, false, true
+		}
+		return field.Name, omitEmpty, false, false
+	}
+	return field.Name, false, false, false
+}
+
+// The fields of a struct, with those of embedded structs promoted. A field
+// of the struct itself wins over a promoted one with the same name.
+func (c *Converter) fields(t reflect.Type, index []int) []fieldInfo {
+	var fields, promoted []fieldInfo
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, omitEmpty, skip, named := c.tag(field)
+		if skip {
+			continue
+		}
+		fieldIndex := append(append([]int(nil), index...), i)
+
+		embedded := field.Type
+		if embedded.Kind() == reflect.Ptr {
+			embedded = embedded.Elem()
+		}
+		if field.Anonymous && !named && embedded.Kind() == reflect.Struct && embedded != timeType && embedded != decimalType {
+			promoted = append(promoted, c.fields(embedded, fieldIndex)...)
+			continue
+		}
+		if field.PkgPath != "" {
+			// Unexported
+			continue
+		}
+		fields = append(fields, fieldInfo{fieldIndex, name, omitEmpty})
+	}
+
+	taken := make(map[string]bool)
+	for _, field := range fields {
+		taken[field.name] = true
+	}
+	for _, field := range promoted {
+		if !taken[field.name] {
+			taken[field.name] = true
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// Gets a field through embedded pointers, which might be nil
+func fieldByIndex(value reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				return reflect.Value{}, false
+			}
+			value = value.Elem()
+		}
+		value = value.Field(x)
+	}
+	return value, true
+}
+
+func isEmptyValue(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return value.Len() == 0
+	}
+	return value.IsZero()
+}
+
+func (c *Converter) convert(value reflect.Value) (interface{}, error) {
+	if !value.IsValid() {
+		return nil, nil
+	}
+
+	info := c.info(value.Type())
+	switch info.how {
+	case convertFollow:
+		if value.IsNil() {
+			return nil, nil
+		}
+		return c.convert(value.Elem())
+	case convertText:
+		if value.Kind() == reflect.Ptr && value.IsNil() {
+			return nil, nil
+		}
+		text, err := value.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return nil, err
+		}
+		return string(text), nil
+	case convertString:
+		if value.Kind() == reflect.Ptr && value.IsNil() {
+			return nil, nil
+		}
+		return value.Interface().(fmt.Stringer).String(), nil
+	case convertStruct:
+		mp := make(map[string]interface{}, len(info.fields))
+		for _, field := range info.fields {
+			fieldValue, ok := fieldByIndex(value, field.index)
+			if !ok || (field.omitEmpty && isEmptyValue(fieldValue)) {
+				continue
+			}
+			val, err := c.convert(fieldValue)
+			if err != nil {
+				return nil, err
+			}
+			mp[field.name] = val
+		}
+		return mp, nil
+	case convertList:
+		if value.Kind() == reflect.Slice && value.IsNil() {
+			return nil, nil
+		}
+		list := make([]interface{}, value.Len())
+		for i := range list {
+			val, err := c.convert(value.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			list[i] = val
+		}
+		return list, nil
+	case convertMap:
+		if value.IsNil() {
+			return nil, nil
+		}
+		mp := make(map[string]interface{}, value.Len())
+		iter := value.MapRange()
+		for iter.Next() {
+			key, err := c.convert(iter.Key())
+			if err != nil {
+				return nil, err
+			}
+			val, err := c.convert(iter.Value())
+			if err != nil {
+				return nil, err
+			}
+			mp[toString(key)] = val
+		}
+		return mp, nil
+	}
+
+	if value.CanInterface() {
+		return value.Interface(), nil
+	}
+	return nil, nil
+}
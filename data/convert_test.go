@@ -0,0 +1,178 @@
+package data
+
+import (
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"net"
+	"testing"
+	"time"
+)
+
+type convertAddress struct {
+	City  string `json:"city"`
+	State string `bson:"st" json:"state"`
+}
+
+type convertAudit struct {
+	CreatedBy string `json:"createdBy"`
+	Note      string `json:"note"`
+}
+
+type convertPlan int
+
+func (p convertPlan) String() string {
+	return [...]string{"none", "PPO", "HMO"}[p]
+}
+
+type convertBroken struct{}
+
+func (b convertBroken) MarshalText() ([]byte, error) {
+	return nil, errors.New("broken")
+}
+
+type convertMember struct {
+	convertAudit
+	Name       string           `json:"name" edl:"fullName"`
+	SSN        string           `json:"-"`
+	Email      string           `json:"email,omitempty"`
+	Phone      string           `json:",omitempty"`
+	Hired      time.Time        `json:"hired"`
+	Terminated *time.Time       `json:"terminated"`
+	Salary     Decimal          `json:"salary"`
+	Plan       convertPlan      `json:"plan"`
+	IP         net.IP           `json:"ip"`
+	Address    *convertAddress  `json:"address"`
+	Dependents []convertAddress `json:"dependents"`
+	Tags       map[int]string   `json:"tags"`
+	Raw        []byte           `json:"raw"`
+	Note       string           `json:"note"`
+	Untagged   int
+	private    string
+}
+
+func TestConverter(t *testing.T) {
+	hired := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+	member := convertMember{
+		convertAudit: convertAudit{"admin", "audit note"},
+		Name:         "Jane Doe",
+		SSN:          "123-45-6789",
+		Hired:        hired,
+		Salary:       NewDecimal(8500050, 2),
+		Plan:         2,
+		IP:           net.ParseIP("10.0.0.1"),
+		Address:      &convertAddress{"Boston", "MA"},
+		Dependents:   []convertAddress{{"Austin", "TX"}},
+		Tags:         map[int]string{1: "new"},
+		Raw:          []byte("raw"),
+		Note:         "member note",
+		Untagged:     7,
+		private:      "hidden",
+	}
+
+	Convey("Converter", t, func() {
+		Convey("Follows the rules for each kind", func() {
+			mp, err := NewConverter("json").Map(&member)
+			So(err, ShouldEqual, nil)
+			So(mp["name"], ShouldEqual, "Jane Doe")
+			So(mp["hired"], ShouldEqual, hired)
+			So(mp["terminated"], ShouldEqual, nil)
+			So(mp["salary"], ShouldResemble, member.Salary)
+			So(mp["plan"], ShouldEqual, "HMO")
+			So(mp["ip"], ShouldEqual, "10.0.0.1")
+			So(mp["address"], ShouldResemble, map[string]interface{}{"city": "Boston", "state": "MA"})
+			So(mp["dependents"], ShouldResemble, []interface{}{map[string]interface{}{"city": "Austin", "state": "TX"}})
+			So(mp["tags"], ShouldResemble, map[string]interface{}{"1": "new"})
+			So(mp["raw"], ShouldResemble, []byte("raw"))
+			So(mp["Untagged"], ShouldEqual, 7)
+		})
+
+		Convey("Keeps what pointers to times and decimals point to", func() {
+			bonus := NewDecimal(50000, 2)
+			mp, _ := NewConverter().Map(struct {
+				When  *time.Time
+				Bonus *Decimal
+				IP    *net.IP
+			}{&hired, &bonus, &member.IP})
+			So(mp["When"], ShouldHaveSameTypeAs, time.Time{})
+			So(mp["When"], ShouldEqual, hired)
+			So(mp["Bonus"], ShouldHaveSameTypeAs, Decimal{})
+			So(mp["Bonus"], ShouldResemble, bonus)
+			So(mp["IP"], ShouldEqual, "10.0.0.1")
+		})
+
+		Convey("Leaves out skipped, empty and unexported fields", func() {
+			mp, _ := NewConverter("json").Map(member)
+			for _, name := range []string{"SSN", "email", "Email", "Phone", "private"} {
+				_, ok := mp[name]
+				So(ok, ShouldEqual, false)
+			}
+
+			member.Phone = "555-1234"
+			mp, _ = NewConverter("json").Map(member)
+			So(mp["Phone"], ShouldEqual, "555-1234")
+		})
+
+		Convey("Promotes embedded fields unless the struct has the same field", func() {
+			mp, _ := NewConverter("json").Map(member)
+			So(mp["createdBy"], ShouldEqual, "admin")
+			So(mp["note"], ShouldEqual, "member note")
+		})
+
+		Convey("Falls back from one tag to the next", func() {
+			mp, _ := NewConverter("edl", "bson", "json").Map(member)
+			So(mp["fullName"], ShouldEqual, "Jane Doe")
+			So(mp["address"].(map[string]interface{})["st"], ShouldEqual, "MA")
+			So(mp["address"].(map[string]interface{})["city"], ShouldEqual, "Boston")
+
+			mp, _ = NewConverter().Map(member)
+			So(mp["Name"], ShouldEqual, "Jane Doe")
+			So(mp["SSN"], ShouldEqual, "123-45-6789")
+		})
+
+		Convey("Rejects things that aren't structs", func() {
+			_, err := NewConverter().Map(map[string]interface{}{})
+			So(err, ShouldHaveSameTypeAs, &SourceError{})
+		})
+
+		Convey("Returns MarshalText errors", func() {
+			_, err := NewConverter().Map(struct{ B convertBroken }{})
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Is what SetSource uses, with only its tag", func() {
+			datum := &Datum{}
+			datum.SetSource(member, "edl")
+			So(datum.Get("{{.fullName}} {{.Address.City}} {{date .Hired \"2006\"}} {{.Plan}}", ""), ShouldEqual, "Jane Doe Boston 2015 HMO")
+			So(datum.Get("{{(first (where .Dependents \"State\" \"TX\")).City}}", ""), ShouldEqual, "Austin")
+			So(datum.Get("{{.address.city}}", "missing"), ShouldEqual, "missing")
+
+			datum.SetSource(member, "")
+			So(datum.Get("{{.Name}} {{.SSN}} {{.CreatedBy}}", ""), ShouldEqual, "Jane Doe 123-45-6789 admin")
+
+			mp, _ := NewConverter("edl", "json").Map(member)
+			datum.SetSource(mp, "")
+			So(datum.Get("{{.fullName}} {{.address.city}}", ""), ShouldEqual, "Jane Doe Boston")
+		})
+	})
+}
+
+func BenchmarkConverter(b *testing.B) {
+	hired := time.Now()
+	member := convertMember{
+		Name:       "Jane Doe",
+		Hired:      hired,
+		Terminated: &hired,
+		Salary:     NewDecimal(8500050, 2),
+		Address:    &convertAddress{"Boston", "MA"},
+		Dependents: []convertAddress{{"Austin", "TX"}, {"Boston", "MA"}},
+	}
+	converter := NewConverter("json")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := converter.Map(&member)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
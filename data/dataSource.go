@@ -8,7 +8,7 @@ type DataSource interface {
 type NilDataSource struct{}
 
 func (n *NilDataSource) Next() (Getter, error) {
-	return &Datum{nil}, nil
+	return &Datum{}, nil
 }
 
 func (n *NilDataSource) HasNext() bool {
@@ -0,0 +1,189 @@
+package data
+
+import (
+	"errors"
+	"time"
+)
+
+// DATE FUNCTIONS
+//
+// Dates can be given as times, GetTimes, or strings in one of TimeFormats.
+
+// Parses a string in the first of TimeFormats that fits
+func parseTime(s string) (time.Time, bool) {
+	for _, format := range TimeFormats {
+		t, err := time.Parse(format, s)
+		if err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func toTime(arg interface{}) (time.Time, error) {
+	switch t := arg.(type) {
+	case time.Time:
+		return t, nil
+	case *time.Time:
+		if t != nil {
+			return *t, nil
+		}
+	case GetTime:
+		return t.GetTime()
+	case string:
+		if parsed, ok := parseTime(t); ok {
+			return parsed, nil
+		}
+		return time.Time{}, errors.New("Invalid date " + t)
+	}
+	return time.Time{}, errors.New("Invalid date " + toString(arg))
+}
+
+// Works out whether two values are to be compared as dates. They are if
+// either one is a time, in which case the other must be one too or a string
+// that parses as one.
+func toTimes(arg1 interface{}, arg2 interface{}) (time.Time, time.Time, bool, error) {
+	if !isTime(arg1) && !isTime(arg2) {
+		return time.Time{}, time.Time{}, false, nil
+	}
+	t1, err1 := toTime(arg1)
+	t2, err2 := toTime(arg2)
+	if err1 != nil || err2 != nil {
+		return t1, t2, true, errors.New("Cannot compare date with non-date")
+	}
+	return t1, t2, true, nil
+}
+
+func isTime(arg interface{}) bool {
+	switch arg.(type) {
+	case time.Time, *time.Time, GetTime:
+		return true
+	}
+	return false
+}
+
+func timeNow() time.Time {
+	return time.Now()
+}
+
+// Parses a date with the given layout (e.g. "01022006"), or with the first
+// of TimeFormats that fits
+func parseDate(args ...interface{}) (time.Time, error) {
+	if len(args) == 0 || len(args) > 2 {
+		return time.Time{}, errors.New("parseDate requires a date and optionally a layout")
+	}
+	if len(args) == 1 {
+		return toTime(args[0])
+	}
+	return time.Parse(toString(args[1]), toString(args[0]))
+}
+
+func addDays(arg interface{}, days interface{}) (time.Time, error) {
+	t, err := toTime(arg)
+	if err != nil {
+		return t, err
+	}
+	n, err := toInt(days)
+	if err != nil {
+		return t, err
+	}
+	return t.AddDate(0, 0, n), nil
+}
+
+// Adds months, keeping to the end of the month when the day doesn't exist
+// in the new one (so Jan 31st plus a month is Feb 28th, not Mar 3rd)
+func addMonths(arg interface{}, months interface{}) (time.Time, error) {
+	t, err := toTime(arg)
+	if err != nil {
+		return t, err
+	}
+	n, err := toInt(months)
+	if err != nil {
+		return t, err
+	}
+
+	first := time.Date(t.Year(), t.Month()+time.Month(n), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	day := t.Day()
+	if last := daysIn(first); day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1), nil
+}
+
+func daysIn(t time.Time) int {
+	return time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, t.Location()).Day()
+}
+
+// Midnight on the first day of the month
+func startOfMonth(arg interface{}) (time.Time, error) {
+	t, err := toTime(arg)
+	if err != nil {
+		return t, err
+	}
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location()), nil
+}
+
+// Midnight on the last day of the month
+func endOfMonth(arg interface{}) (time.Time, error) {
+	t, err := toTime(arg)
+	if err != nil {
+		return t, err
+	}
+	return time.Date(t.Year(), t.Month(), daysIn(t), 0, 0, 0, 0, t.Location()), nil
+}
+
+// Age in whole years as of a date, or as of now
+func age(args ...interface{}) (int, error) {
+	if len(args) == 0 || len(args) > 2 {
+		return 0, errors.New("age requires a date of birth and optionally the date to work it out for")
+	}
+	birth, err := toTime(args[0])
+	if err != nil {
+		return 0, err
+	}
+	asOf := time.Now()
+	if len(args) == 2 {
+		asOf, err = toTime(args[1])
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	years := asOf.Year() - birth.Year()
+	if asOf.Month() < birth.Month() || (asOf.Month() == birth.Month() && asOf.Day() < birth.Day()) {
+		years--
+	}
+	return years, nil
+}
+
+// Calendar days from the first date to the second, ignoring the time of day
+func diffDays(from interface{}, to interface{}) (int, error) {
+	t1, err := toTime(from)
+	if err != nil {
+		return 0, err
+	}
+	t2, err := toTime(to)
+	if err != nil {
+		return 0, err
+	}
+	return int(epochDays(t2) - epochDays(t1)), nil
+}
+
+// Days from 1970-01-01 to the date, counted without a time.Duration, which
+// only reaches about 292 years (and 0001-01-01 is a common "no date" date)
+func epochDays(t time.Time) int64 {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Unix() / (24 * 60 * 60)
+}
+
+// The same moment in an IANA time zone, e.g. "America/New_York"
+func inZone(arg interface{}, zone string) (time.Time, error) {
+	t, err := toTime(arg)
+	if err != nil {
+		return t, err
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return t, err
+	}
+	return t.In(loc), nil
+}
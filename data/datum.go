@@ -1,45 +1,82 @@
 package data
 
 import (
-	"bytes"
-	"github.com/fatih/structs"
-	"html/template"
 	"reflect"
 	"time"
 )
 
 var DefaultDecimalCount = 8
 
+// Layouts that date strings are parsed with, in order, e.g. when a date is
+// compared with a string
 var TimeFormats = []string{
 	"2006-01-02 15:04:05",
 	time.RFC3339,
 	time.RFC1123,
 	time.RFC3339Nano,
+	"2006-01-02",
+	"01/02/2006",
+	"20060102",
 }
 
 type Datum struct {
 	Source interface{}
+	// How values are escaped (see the ESCAPE constants). Defaults to
+	// ESCAPE_NONE.
+	Escape int
+	// When Get falls back to its default (see the DEFAULT_ON constants).
+	// Defaults to DEFAULT_ON_ALL.
+	DefaultOn int
 }
 
+// When to use the default value instead of what the key evaluates to. They
+// can be combined, e.g. DEFAULT_ON_EMPTY | DEFAULT_ON_MISSING.
+const (
+	// The key evaluates to an empty string
+	DEFAULT_ON_EMPTY = 1 << iota
+	// The key refers to something that isn't in the source
+	DEFAULT_ON_MISSING
+	// The key fails to evaluate (e.g. a function is given the wrong type)
+	DEFAULT_ON_ERROR
+
+	DEFAULT_ON_ALL = DEFAULT_ON_EMPTY | DEFAULT_ON_MISSING | DEFAULT_ON_ERROR
+)
+
 // Converts the source (map or struct) to a map so that the template engine won't panic when trying to access
 // invalid properties.
-// If the src is a struct, look at the tagName to see what the map keys should be when converted to a map
+// If the src is a struct, look at the tagName to see what the map keys should be when converted to a map (see
+// Converter). Fields without the tag, or every field if tagName is "", keep their Go names.
 func (d *Datum) SetSource(src interface{}, tagName string) {
+	err := d.SetSourceE(src, tagName)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// SetSourceE is the same as SetSource, but returns a *SourceError instead of
+// panicking if src isn't a map or struct, and returns any error converting a
+// struct (e.g. from a MarshalText)
+func (d *Datum) SetSourceE(src interface{}, tagName string) error {
 	value := reflect.ValueOf(src)
 	for value.Kind() == reflect.Ptr {
 		value = value.Elem()
 	}
 	if value.Kind() == reflect.Struct {
-		converter := structs.New(src)
-		converter.TagName = tagName
-		mp := converter.Map()
+		converter := NewConverter()
+		if len(tagName) > 0 {
+			converter = NewConverter(tagName)
+		}
+		mp, err := converter.Map(src)
+		if err != nil {
+			return err
+		}
 		d.Source = mp
 	} else if value.Kind() == reflect.Map {
 		d.Source = src
 	} else {
-		panic("Invalid type for emissary datum source (" + value.Kind().String() + ")")
+		return &SourceError{value.Kind()}
 	}
-
+	return nil
 }
 
 // A getter is any type that can Get a key, with a default value and return a string
@@ -47,18 +84,85 @@ type Getter interface {
 	Get(key string, defaultValue string) string
 }
 
+// Get evaluates the EDL key against the source. The default value, which may
+// also be EDL, is used instead when the datum's DefaultOn says. An empty
+// default is never used.
 func (d *Datum) Get(key string, defaultValue string) string {
-	tmpl, err := template.New("tmpl").Funcs(funcMap).Parse(key)
+	return d.GetEscaped(key, defaultValue, d.Escape)
+}
+
+// GetE is the same as Get, but returns an *EvalError instead of panicking
+// if the key can't be parsed or evaluated
+func (d *Datum) GetE(key string, defaultValue string) (string, error) {
+	return d.GetEscapedE(key, defaultValue, d.Escape)
+}
+
+// GetEscaped is the same as Get, but escapes values with the given mode
+// instead of the datum's
+func (d *Datum) GetEscaped(key string, defaultValue string, mode int) string {
+	val, err := d.GetEscapedE(key, defaultValue, mode)
 	if err != nil {
 		panic(err)
 	}
+	return val
+}
+
+// GetEscapedE is the same as GetEscaped, but returns an *EvalError instead of
+// panicking
+func (d *Datum) GetEscapedE(key string, defaultValue string, mode int) (string, error) {
+	expr, err := CompileEscaped(key, mode)
+	if err != nil {
+		return "", err
+	}
+	def, err := CompileEscaped(defaultValue, mode)
+	if err != nil {
+		return "", err
+	}
+	return d.EvalE(expr, def)
+}
+
+// An ErrorGetter is a Getter that can return errors instead of panicking
+type ErrorGetter interface {
+	Getter
+	GetE(key string, defaultValue string) (string, error)
+}
+
+// An Evaluator is a Getter that can evaluate compiled expressions, which
+// saves parsing the same key for every row
+type Evaluator interface {
+	Getter
+	EvalE(expr *Expr, defaultValue *Expr) (string, error)
+}
 
-	buf := &bytes.Buffer{}
-	err = tmpl.Execute(buf, d.Source)
+// Eval is the same as Get, but with a compiled key. Values are escaped the
+// way expr says, or else the way the datum says.
+func (d *Datum) Eval(expr *Expr, defaultValue *Expr) string {
+	val, err := d.EvalE(expr, defaultValue)
 	if err != nil {
 		panic(err)
 	}
+	return val
+}
+
+// EvalE is the same as Eval, but returns an *EvalError instead of panicking
+func (d *Datum) EvalE(expr *Expr, defaultValue *Expr) (string, error) {
+	return expr.evalDefault(d.Source, defaultValue, d.Escape, d.DefaultOn)
+}
 
-	return buf.String()
+// GetValue is the same as GetE, but returns a typed value (see Value)
+func (d *Datum) GetValue(key string, defaultValue string) (Value, error) {
+	expr, err := Compile(key)
+	if err != nil {
+		return Value{}, err
+	}
+	def, err := Compile(defaultValue)
+	if err != nil {
+		return Value{}, err
+	}
+	return d.EvalValue(expr, def)
+}
 
+// EvalValue is the same as EvalE, but returns a typed value (see Value)
+func (d *Datum) EvalValue(expr *Expr, defaultValue *Expr) (Value, error) {
+	return expr.evalValueDefault(d.Source, defaultValue, d.Escape, d.DefaultOn)
 }
@@ -3,6 +3,7 @@ package data
 import (
 	"fmt"
 	. "github.com/smartystreets/goconvey/convey"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -25,6 +26,22 @@ var dm = map[string]interface{}{
 	"k": false,
 	"l": now.Add(10 * time.Minute),
 	"m": now,
+	"n": "AT&T",
+	"o": "O'Brien <o@example.com>",
+	"p": "=SUM(A1:A2)",
+	"q": "-12.5",
+	"r": "  John O'BRIEN-smith ",
+	"s": "123-45-6789",
+	"t": 4721,
+	"u": []string{"a", "b", "c"},
+	"v": 0.1,
+	"w": "1234567.895",
+	"x": "",
+	"y": []interface{}{
+		map[string]interface{}{"name": "Ann", "relationship": "spouse", "age": 41, "premium": "120.10"},
+		map[string]interface{}{"name": "Bo", "relationship": "child", "age": 9, "premium": "35.05"},
+		map[string]interface{}{"name": "Cy", "relationship": "child", "age": 12},
+	},
 }
 
 type a struct {
@@ -58,6 +75,159 @@ var assertions = []a{
 	a{"{{if (gt .h .l)}}h{{else}}l{{end}}", "l"},
 	a{"{{if (eq .h .l)}}h{{else}}l{{end}}", "l"},
 	a{"{{if (eq .h .m)}}y{{else}}n{{end}}", "y"},
+	a{"{{.n}}", "AT&T"},
+	a{"{{.o}}", "O'Brien <o@example.com>"},
+	a{"<{{.n}}> & \"{{.e}}\"", "<AT&T> & \"bar\""},
+
+	// Math
+	a{"{{add .v 0.2}}", "0.3"},
+	a{"{{sub 1 .v .v .v}}", "0.7"},
+	a{"{{mult .w 100}}", "123456789.5"},
+	a{"{{div 1 3}}", "0.33333333"},
+	a{"{{div 10 4}}", "2.5"},
+	a{"{{add .a .x .boof}}", "10"},
+	a{"{{add .a .e}} {{sub \"N/A\" 1}} {{mult .a true}} {{sum .y \"name\"}}", "10 -1 0 0"},
+	a{"{{round 2.5 0}} {{round 2.5 0 \"halfEven\"}} {{round 2.59 1 \"truncate\"}}", "3 2 2.5"},
+	a{"{{number .w 2}}", "1234567.90"},
+	a{"{{number .w 2 \"truncate\"}}", "1234567.89"},
+	a{"{{number 0.125 2 \"halfEven\"}}", "0.12"},
+	a{"{{number .a}}", "10"},
+	a{"{{number .w (add 1 1)}} {{round 1234 -2}}", "1234567.90 1200"},
+	a{"{{padLeft .t (add 2 3) \"0\"}} {{repeat \"ab\" (div 4 2)}}", "04721 abab"},
+	a{"{{at .u (mult 1 2)}} {{mask .s (add 2 2)}}", "c ***-**-6789"},
+	a{"{{currency .w}}", "$1,234,567.90"},
+	a{"{{currency .w \"truncate\"}}", "$1,234,567.89"},
+	a{"{{currency (mult 3 .v)}}", "$0.30"},
+	a{"{{currency -1234.5}}", "$-1,234.50"},
+	a{"{{currency .e}}", "bar"},
+	a{"{{if (eq (add .v 0.2) 0.3)}}yes{{else}}no{{end}}", "yes"},
+	a{"{{if (gt (mult .a 2) 19)}}yes{{else}}no{{end}}", "yes"},
+	a{"{{if (lt (div 1 3) \"0.34\")}}yes{{else}}no{{end}}", "yes"},
+
+	// Strings
+	a{"{{upper .e}}", "BAR"},
+	a{"{{lower .n}}", "at&t"},
+	a{"{{title (trim .r)}}", "John O'brien-Smith"},
+	a{"[{{trim .r}}]", "[John O'BRIEN-smith]"},
+	a{"[{{trimLeft .r}}]", "[John O'BRIEN-smith ]"},
+	a{"[{{trimRight .r}}]", "[  John O'BRIEN-smith]"},
+	a{"{{trim \"--x--\" \"-\"}}", "x"},
+	a{"{{trimLeft \"00042\" \"0\"}}", "42"},
+	a{"{{trimRight \"4.500\" \"0\"}}", "4.5"},
+	a{"{{padLeft .t 9 \"0\"}}", "000004721"},
+	a{"[{{padLeft .e 5}}]", "[  bar]"},
+	a{"{{padRight .e 6 \"*\"}}", "bar***"},
+	a{"{{padRight .f.g 2 \"*\"}}", "boop"},
+	a{"{{replace .s \"-\" \"\"}}", "123456789"},
+	a{"{{regexReplace .s \"^(\\\\d{3})-(\\\\d{2})\" \"XXX-XX\"}}", "XXX-XX-6789"},
+	a{"{{regexReplace .r \"\\\\s+\" \" \"}}", " John O'BRIEN-smith "},
+	a{"{{regexMatch .s \"^\\\\d{3}-\\\\d{2}-\\\\d{4}$\"}}", "true"},
+	a{"{{regexMatch .e \"^\\\\d+$\"}}", "false"},
+	a{"{{join (split .s \"-\") \"/\"}}", "123/45/6789"},
+	a{"{{join .u \", \"}}", "a, b, c"},
+	a{"{{len (split .s \"-\")}}", "3"},
+	a{"{{contains .n \"&\"}}", "true"},
+	a{"{{hasPrefix .s \"123\"}}", "true"},
+	a{"{{hasSuffix .s \"123\"}}", "false"},
+	a{"{{length .e}} {{length .u}} {{length .t}} {{length .boof}} {{len .e}} {{len .u}}", "3 3 4 0 3 3"},
+	a{"{{repeat \"ab\" 3}}", "ababab"},
+	a{"{{.e | upper}}", "BAR"},
+	a{"{{upper .boof}}", ""},
+
+	// Locales
+	a{"{{currencyIn .w \"USD\"}}", "$1,234,567.90"},
+	a{"{{currencyIn .w \"EUR\" \"de-DE\"}}", "1.234.567,90 €"},
+	a{"{{currencyIn .w \"eur\" \"fr_fr\"}}", "1 234 567,90 €"},
+	a{"{{currencyIn .w \"CHF\" \"de-CH\"}}", "CHF 1'234'567.90"},
+	a{"{{currencyIn .w \"JPY\" \"ja-JP\"}}", "¥1,234,568"},
+	a{"{{currencyIn .w \"BHD\" \"en-GB\" \"truncate\"}}", "BHD1,234,567.895"},
+	a{"{{currencyIn -1234.5 \"USD\"}}", "-$1,234.50"},
+	a{"{{currencyIn -1234.5 \"USD\" \"parens\"}}", "($1,234.50)"},
+	a{"{{currencyIn .q \"EUR\" \"de-DE\" \"parens\"}}", "(12,50 €)"},
+	a{"{{currencyIn .w \"USD\" \"en-US\" \"code\" \"noGroup\"}}", "USD 1234567.90"},
+	a{"{{numberIn .w 2 \"de-DE\"}}", "1.234.567,90"},
+	a{"{{numberIn .w 1 \"en-US\" \"truncate\"}}", "1,234,567.8"},
+	a{"{{numberIn .q 0 \"en-US\" \"parens\" \"halfEven\"}}", "(12)"},
+	a{"{{numberIn .t 0 \"fr-FR\"}}", "4 721"},
+	a{"{{impliedDecimal 123.45 2 9}}", "000012345"},
+	a{"{{impliedDecimal .q 2 6}}", "-01250"},
+	a{"{{impliedDecimal .w 2}}", "123456790"},
+	a{"{{impliedDecimal .a 0 3}}", "010"},
+
+	// Collections
+	a{"{{(first .y).name}} {{(last .y).name}} {{first .boof}}", "Ann Cy "},
+	a{"{{at .y 1 \"name\"}} {{at .y -1 \"name\"}} {{at .y 5 \"name\"}} {{at .u 0}} {{index .u 0}}", "Bo Cy  a a"},
+	a{"{{at .f \"g\"}} {{index .f \"g\"}}", "boop boop"},
+	a{"{{count .y}} {{count .y \"relationship\" \"child\"}} {{count .boof}}", "3 2 0"},
+	a{"{{(first (where .y \"relationship\" \"spouse\")).name}}", "Ann"},
+	a{"{{join (pluck (filter .y \"age\" \"lt\" 26) \"name\") \", \"}}", "Bo, Cy"},
+	a{"{{join (pluck .y \"name\") \"/\"}}", "Ann/Bo/Cy"},
+	a{"{{sum .y \"premium\"}} {{sum (pluck .y \"age\")}}", "155.15 62"},
+	a{"{{join (pluck (sortBy .y \"age\") \"name\") \",\"}}", "Bo,Cy,Ann"},
+	a{"{{join (pluck (sortBy .y \"age\" \"desc\") \"name\") \",\"}}", "Ann,Cy,Bo"},
+	a{"{{join (uniq (pluck .y \"relationship\")) \",\"}}", "spouse,child"},
+	a{"{{range where .y \"age\" 9}}{{.name}}{{end}}", "Bo"},
+
+	// Empty values and logic
+	a{"{{coalesce .boof .x .e \"N/A\"}} {{coalesce .boof .x}}", "bar "},
+	a{"{{coalesce .x \"N/A\"}} {{coalesce 0 1}}", "N/A 0"},
+	a{"{{.x | default \"N/A\"}} {{default \"N/A\" .e}} {{.boof.bloop | default 0}}", "N/A bar 0"},
+	a{"{{empty .x}} {{empty .boof}} {{empty .u}} {{empty .a}} {{notEmpty \"  \"}}", "true true false false false"},
+	a{"{{ifThen .j \"yes\" \"no\"}} {{ifThen .k \"yes\" \"no\"}} {{ifThen .boof \"yes\"}}", "yes no "},
+	a{"{{ifThen \"false\" 1 2}} {{ifThen \"0.00\" 1 2}} {{ifThen .q 1 2}} {{ifThen .y 1 2}}", "2 2 1 1"},
+	a{"{{all .j .a .e}} {{all .j \"0\"}} {{all .boof}}", "true false false"},
+	a{"{{any .k .x .boof}} {{any .k .e}} {{any \"false\" \"0.0\"}}", "false true false"},
+	a{"{{none .x}} {{none .a}} {{none \"FALSE\"}} {{none .k .j}}", "true false true false"},
+	a{"{{if all .j (none .k)}}yes{{else}}no{{end}}", "yes"},
+	// The engine's and, or and not are as they were
+	a{"{{or .x .e}} {{or .boof \"N/A\"}} {{and .j .e}} {{and .x .e}}|{{not \"0\"}}", "bar N/A bar |false"},
+	a{"{{if and .j (not .k)}}yes{{else}}no{{end}}", "yes"},
+	a{"{{eq .boof .x}} {{eq .boof nil}} {{eq .a .boof}} {{eq .boof .a .boof}}", "false true false true"},
+	a{"{{lt .boof .a}} {{lt .a .boof}} {{gt .a .boof}} {{lte .boof .boof}}", "true false true true"},
+	a{"{{eq .a \"10\"}} {{eq .a 10.0}} {{eq .q -12.5}} {{lt .q 0}} {{gt \"120.10\" 35}}", "true true true true true"},
+	a{"{{eq \"007\" \"7\"}} {{lt \"10\" \"9\"}}", "false true"},
+}
+
+// Keys that fail to evaluate
+var failures = []string{
+	"{{padLeft .e 5 \"00\"}}",
+	"{{padLeft .e \"x\"}}",
+	"{{regexMatch .e \"(\"}}",
+	"{{repeat .e -1}}",
+	"{{join .e \",\"}}",
+	"{{div .a 0}}",
+	"{{round .a 2 \"up\"}}",
+	"{{if (eq (add 1 1) .e)}}{{end}}",
+	"{{currencyIn .a \"XYZ\"}}",
+	"{{currencyIn .a \"USD\" \"xx-XX\"}}",
+	"{{numberIn .a 2 \"en-US\" \"bold\"}}",
+	"{{impliedDecimal 123.45 2 4}}",
+	"{{padLeft .e \"1e30\"}}",
+	"{{count .e}}",
+	"{{filter .y \"age\" \"like\" 9}}",
+	"{{sortBy .y \"age\" \"up\"}}",
+	"{{lookup \"plans\" .e}}",
+	"{{lt .j .a}}",
+	"{{eq .e 10}}",
+	"{{mask .e -1}}",
+	// The engine's own index and len are as they were
+	"{{index .u 5}}",
+	"{{index .u -1}}",
+	"{{len .t}}",
+}
+
+func TestFailures(t *testing.T) {
+	datum := &Datum{}
+	datum.SetSource(dm, "")
+
+	Convey("Failures", t, func() {
+		for _, key := range failures {
+			Convey(key, func() {
+				_, err := datum.GetE(key, "")
+				So(err, ShouldNotEqual, nil)
+			})
+		}
+	})
 }
 
 func TestDataMap(t *testing.T) {
@@ -73,3 +243,294 @@ func TestDataMap(t *testing.T) {
 
 	})
 }
+
+func TestEscape(t *testing.T) {
+	Convey("Escaping", t, func() {
+		datum := &Datum{}
+		datum.SetSource(dm, "")
+
+		Convey("Is off by default", func() {
+			So(datum.Get("{{.o}}", ""), ShouldEqual, "O'Brien <o@example.com>")
+		})
+
+		Convey("Escapes HTML", func() {
+			So(datum.GetEscaped("<b>{{.n}}</b>", "", ESCAPE_HTML), ShouldEqual, "<b>AT&amp;T</b>")
+			So(datum.GetEscaped("{{.o}}", "", ESCAPE_HTML), ShouldEqual, "O&#39;Brien &lt;o@example.com&gt;")
+		})
+
+		Convey("Escapes XML", func() {
+			So(datum.GetEscaped("{{.o}}", "", ESCAPE_XML), ShouldEqual, "O&apos;Brien &lt;o@example.com&gt;")
+		})
+
+		Convey("Makes values safe for spreadsheets", func() {
+			So(datum.GetEscaped("{{.p}}", "", ESCAPE_CSV), ShouldEqual, "'=SUM(A1:A2)")
+			So(datum.GetEscaped("{{.q}}", "", ESCAPE_CSV), ShouldEqual, "-12.5")
+			So(datum.GetEscaped("{{.n}}", "", ESCAPE_CSV), ShouldEqual, "AT&T")
+		})
+
+		Convey("Makes the whole cell safe, not each value", func() {
+			datum := &Datum{}
+			datum.SetSource(map[string]interface{}{"x": "-foo", "tab": "\tcmd", "cr": "\rcmd", "a": 1, "n": -5}, "")
+			So(datum.GetEscaped("{{.a}} {{.x}}", "", ESCAPE_CSV), ShouldEqual, "1 -foo")
+			So(datum.GetEscaped("{{.n}}", "", ESCAPE_CSV), ShouldEqual, "-5")
+			So(datum.GetEscaped("={{.n}}", "", ESCAPE_CSV), ShouldEqual, "'=-5")
+			So(datum.GetEscaped("{{.x}}", "", ESCAPE_CSV), ShouldEqual, "'-foo")
+			So(datum.GetEscaped("{{.tab}}", "", ESCAPE_CSV), ShouldEqual, "'\tcmd")
+			So(datum.GetEscaped("{{.cr}}", "", ESCAPE_CSV), ShouldEqual, "'\rcmd")
+			So(datum.GetEscaped("{{.missing}}", "@x", ESCAPE_CSV), ShouldEqual, "'@x")
+
+			val, _ := datum.GetValue("{{.x}}", "")
+			So(val.String(), ShouldEqual, "-foo")
+			expr, _ := CompileEscaped("{{.x}}", ESCAPE_CSV)
+			val, _ = expr.EvalValue(datum.Source)
+			So(val.String(), ShouldEqual, "'-foo")
+			So(val.Interface(), ShouldEqual, "-foo")
+		})
+
+		Convey("Uses the datum's mode", func() {
+			datum.Escape = ESCAPE_HTML
+			So(datum.Get("{{.n}}", ""), ShouldEqual, "AT&amp;T")
+			So(datum.GetEscaped("{{.n}}", "", ESCAPE_DEFAULT), ShouldEqual, "AT&amp;T")
+			So(datum.GetEscaped("{{.n}}", "", ESCAPE_NONE), ShouldEqual, "AT&T")
+		})
+
+		Convey("Escapes inside blocks but not variables", func() {
+			key := "{{$name := .n}}{{if .j}}{{$name}}{{end}}{{range $i, $v := .b}}{{$v}}{{end}}"
+			So(datum.GetEscaped(key, "", ESCAPE_HTML), ShouldEqual, "AT&amp;T2.5")
+		})
+
+		Convey("Prints what pointers point to", func() {
+			five, name := 5, "AT&T"
+			var missing *int
+			datum := &Datum{}
+			datum.SetSource(map[string]interface{}{"five": &five, "name": &name, "missing": missing}, "")
+			So(datum.GetEscaped("{{.five}} {{.name}} [{{.missing}}]", "", ESCAPE_HTML), ShouldEqual, "5 AT&amp;T []")
+			So(datum.Get("{{.missing}}", "none"), ShouldEqual, "none")
+			val, err := datum.GetValue("{{.five}}", "")
+			So(err, ShouldEqual, nil)
+			So(val.Kind, ShouldEqual, VALUE_NUMBER)
+			val, _ = datum.GetValue("{{.missing}}", "")
+			So(val.IsNull(), ShouldBeTrue)
+		})
+	})
+}
+
+func TestErrors(t *testing.T) {
+	Convey("Errors", t, func() {
+		datum := &Datum{}
+		datum.SetSource(dm, "")
+
+		Convey("GetE returns the value", func() {
+			val, err := datum.GetE("{{.e}}", "")
+			So(err, ShouldEqual, nil)
+			So(val, ShouldEqual, "bar")
+		})
+
+		Convey("Parse errors have the key and line", func() {
+			_, err := datum.GetE("{{.e}}\n{{.f.g", "")
+			evalErr, ok := err.(*EvalError)
+			So(ok, ShouldEqual, true)
+			So(evalErr.Key, ShouldEqual, "{{.e}}\n{{.f.g")
+			So(evalErr.Line, ShouldEqual, 2)
+		})
+
+		Convey("Undefined functions are named", func() {
+			_, err := datum.GetE("{{nope .e}}", "")
+			So(err.(*EvalError).Func, ShouldEqual, "nope")
+		})
+
+		Convey("Execution errors have the position and function", func() {
+			_, err := datum.GetE("{{if (gt .e 9)}}yes{{end}}", "")
+			evalErr := err.(*EvalError)
+			So(evalErr.Line, ShouldEqual, 1)
+			So(evalErr.Col, ShouldEqual, 7)
+			So(evalErr.Func, ShouldEqual, "gt")
+			So(evalErr.Message, ShouldEqual, "incompatible types for comparison")
+			So(err.Error(), ShouldEqual, `EDL error in "{{if (gt .e 9)}}yes{{end}}" at line 1, col 7 (gt): incompatible types for comparison`)
+		})
+
+		Convey("Get still panics", func() {
+			So(func() {
+				datum.Get("{{.e", "")
+			}, ShouldPanic)
+		})
+
+		Convey("SetSourceE rejects other kinds", func() {
+			err := datum.SetSourceE(5, "")
+			So(err, ShouldNotEqual, nil)
+			So(err.(*SourceError).Kind, ShouldEqual, reflect.Int)
+			So(err.Error(), ShouldEqual, "Invalid type for emissary datum source (int)")
+		})
+	})
+}
+
+func TestDefault(t *testing.T) {
+	Convey("Defaults", t, func() {
+		datum := &Datum{}
+		datum.SetSource(dm, "")
+
+		Convey("Aren't used when there's a value", func() {
+			So(datum.Get("{{.e}}", "none"), ShouldEqual, "bar")
+		})
+
+		Convey("Are used when the value is empty", func() {
+			So(datum.Get("{{if .k}}yes{{end}}", "none"), ShouldEqual, "none")
+		})
+
+		Convey("Are used when a key is missing", func() {
+			So(datum.Get("{{.boof.bloop}}", "none"), ShouldEqual, "none")
+			So(datum.Get("Name: {{.boof}}", "none"), ShouldEqual, "none")
+		})
+
+		Convey("Are used when evaluation fails", func() {
+			val, err := datum.GetE("{{if (gt .e 9)}}yes{{end}}", "none")
+			So(err, ShouldEqual, nil)
+			So(val, ShouldEqual, "none")
+		})
+
+		Convey("Can be EDL", func() {
+			So(datum.Get("{{.boof}}", "{{.f.g}} ({{.e}})"), ShouldEqual, "boop (bar)")
+		})
+
+		Convey("Aren't used when they're empty", func() {
+			So(datum.Get("Name: {{.boof}}", ""), ShouldEqual, "Name: ")
+			_, err := datum.GetE("{{if (gt .e 9)}}yes{{end}}", "")
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Can be limited to some cases", func() {
+			datum.DefaultOn = DEFAULT_ON_MISSING
+			So(datum.Get("{{if .k}}yes{{end}}", "none"), ShouldEqual, "")
+			So(datum.Get("Name: {{.boof}}", "none"), ShouldEqual, "none")
+			_, err := datum.GetE("{{if (gt .e 9)}}yes{{end}}", "none")
+			So(err, ShouldNotEqual, nil)
+
+			datum.DefaultOn = DEFAULT_ON_EMPTY
+			So(datum.Get("Name: {{.boof}}", "none"), ShouldEqual, "Name: ")
+			So(datum.Get("{{.boof}}", "none"), ShouldEqual, "none")
+		})
+
+		Convey("Can be limited per expression", func() {
+			expr, _ := Compile("Name: {{.boof}}")
+			def, _ := Compile("none")
+			So(datum.Eval(expr, def), ShouldEqual, "none")
+			So(datum.Eval(expr.WithDefaultOn(DEFAULT_ON_EMPTY), def), ShouldEqual, "Name: ")
+		})
+	})
+}
+
+func TestDates(t *testing.T) {
+	datum := &Datum{}
+	datum.SetSource(map[string]interface{}{
+		"dob":       time.Date(1980, 6, 15, 0, 0, 0, 0, time.UTC),
+		"effective": time.Date(2015, 6, 14, 0, 0, 0, 0, time.UTC),
+		"jan31":     time.Date(2016, 1, 31, 9, 30, 0, 0, time.UTC),
+		"partner":   "06/15/1980",
+		"compact":   "19800615",
+		"instant":   "2015-11-01T05:30:00Z",
+	}, "")
+
+	dateAssertions := []a{
+		a{`{{date (parseDate .partner) "2006-01-02"}}`, "1980-06-15"},
+		a{`{{date (parseDate .compact "20060102") "Jan 2, 2006"}}`, "Jun 15, 1980"},
+		a{`{{date .partner "2006-01-02"}}`, "1980-06-15"},
+		a{`{{date (addDays .effective 30) "2006-01-02"}}`, "2015-07-14"},
+		a{`{{date (addDays .effective -14) "2006-01-02"}}`, "2015-05-31"},
+		a{`{{date (addDays .effective (add 1 2)) "2006-01-02"}}`, "2015-06-17"},
+		a{`{{date (addMonths .effective (mult 2 6)) "2006-01-02"}}`, "2016-06-14"},
+		a{`{{date (addMonths .jan31 1) "2006-01-02 15:04"}}`, "2016-02-29 09:30"},
+		a{`{{date (addMonths .jan31 -2) "2006-01-02"}}`, "2015-11-30"},
+		a{`{{date (addMonths .effective 12) "2006-01-02"}}`, "2016-06-14"},
+		a{`{{date (startOfMonth .jan31) "2006-01-02 15:04"}}`, "2016-01-01 00:00"},
+		a{`{{date (endOfMonth (addMonths .jan31 1)) "2006-01-02"}}`, "2016-02-29"},
+		a{`{{age .dob .effective}}`, "34"},
+		a{`{{age .dob (addDays .effective 1)}}`, "35"},
+		a{`{{age .partner "2015-06-15"}}`, "35"},
+		a{`{{diffDays .dob .partner}}`, "0"},
+		a{`{{diffDays .effective .jan31}}`, "231"},
+		a{`{{diffDays .jan31 .effective}}`, "-231"},
+		a{`{{diffDays "0001-01-01" "2020-01-01"}} {{diffDays "9999-12-31" "0001-01-01"}}`, "737424 -3652058"},
+		a{`{{date (inZone .instant "America/New_York") "2006-01-02 15:04 MST"}}`, "2015-11-01 01:30 EDT"},
+		a{`{{if (lt .dob "1990-01-01")}}yes{{else}}no{{end}}`, "yes"},
+		a{`{{if (gt "06/16/1980" .dob)}}yes{{else}}no{{end}}`, "yes"},
+		a{`{{if (eq .dob .partner)}}yes{{else}}no{{end}}`, "yes"},
+		a{`{{if (gte .effective (addMonths .effective 0))}}yes{{else}}no{{end}}`, "yes"},
+		a{`{{if (lt (now) .dob)}}yes{{else}}no{{end}}`, "no"},
+	}
+
+	Convey("Dates", t, func() {
+		for i, assertion := range dateAssertions {
+			Convey(fmt.Sprintf("Assertion #%d :: %s => %s", i+1, assertion.key, assertion.expectation), func() {
+				So(datum.Get(assertion.key, ""), ShouldEqual, assertion.expectation)
+			})
+		}
+
+		Convey("Fail on things that aren't dates", func() {
+			for _, key := range []string{
+				`{{lt .dob "next tuesday"}}`,
+				`{{addDays "yesterday" 1}}`,
+				`{{inZone .dob "Mars/Olympus_Mons"}}`,
+				`{{parseDate .partner "2006-01-02"}}`,
+			} {
+				_, err := datum.GetE(key, "")
+				So(err, ShouldNotEqual, nil)
+			}
+		})
+	})
+}
+
+func TestPII(t *testing.T) {
+	datum := &Datum{}
+	datum.SetSource(map[string]interface{}{
+		"ssn":     "123-45-6789",
+		"card":    "4111 1111 1111 1111",
+		"blob":    []byte{0xde, 0xad, 0xbe, 0xef},
+		"encoded": "TydCcmllbiA8b0BleGFtcGxlLmNvbT4",
+		"missing": "",
+	}, "")
+
+	Convey("PII", t, func() {
+		So(RegisterHMACKey("partner", []byte("secret")), ShouldEqual, nil)
+
+		piiAssertions := []a{
+			a{`{{mask .ssn 4}}`, "***-**-6789"},
+			a{`{{mask .card 4 "X"}}`, "XXXX XXXX XXXX 1111"},
+			a{`{{mask .ssn 20}}`, "123-45-6789"},
+			a{`{{mask .missing 4}}`, ""},
+			a{`{{sha256 .ssn}}`, "01a54629efb952287e554eb23ef69c52097a75aecc0e3a93ca0855ab6d7a31a0"},
+			a{`{{sha256 .missing}}`, ""},
+			a{`{{hmac .ssn "partner"}}`, "b52e28fe1cebd683c3945e56b38ca4490aa13bc4681f0957e740766b74f292e2"},
+			a{`{{base64enc "O'Brien <o@example.com>"}}`, "TydCcmllbiA8b0BleGFtcGxlLmNvbT4="},
+			a{`{{base64dec .encoded}}`, "O'Brien <o@example.com>"},
+			a{`{{base64dec (base64enc .ssn)}}`, "123-45-6789"},
+			a{`{{hex .blob}} {{hex "AT"}}`, "deadbeef 4154"},
+			a{`{{uuid5 "python.org" "dns"}}`, "886313e1-3b8a-5372-9b90-0c9aee199e5d"},
+			a{`{{uuid5 .ssn "6ba7b811-9dad-11d1-80b4-00c04fd430c8"}}`, "9a0ecc15-9be2-5beb-ba39-082071fc0103"},
+		}
+		for i, assertion := range piiAssertions {
+			Convey(fmt.Sprintf("Assertion #%d :: %s => %s", i+1, assertion.key, assertion.expectation), func() {
+				So(datum.Get(assertion.key, ""), ShouldEqual, assertion.expectation)
+			})
+		}
+
+		Convey("Fail without a registered key or with bad input", func() {
+			for _, key := range []string{
+				`{{hmac .ssn "unknown"}}`,
+				`{{base64dec "not base64!"}}`,
+				`{{uuid5 .ssn "not-a-uuid"}}`,
+				`{{mask .ssn 4 "**"}}`,
+			} {
+				_, err := datum.GetE(key, "")
+				So(err, ShouldNotEqual, nil)
+			}
+
+			_, err := datum.GetE("{{mask .ssn -1}}", "")
+			So(err.(*EvalError).Message, ShouldEqual, "mask can't keep fewer than 0 characters, got -1")
+		})
+
+		Convey("Refuse empty key names and keys", func() {
+			So(RegisterHMACKey("", []byte("secret")), ShouldEqual, ErrInvalidKeyName)
+			So(RegisterHMACKey("partner", nil), ShouldEqual, ErrInvalidKey)
+		})
+	})
+}
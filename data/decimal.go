@@ -0,0 +1,347 @@
+package data
+
+import (
+	"errors"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Rounding modes for decimals
+const (
+	// Halves round away from zero: 2.5 becomes 3, -2.5 becomes -3
+	ROUND_HALF_UP = iota
+	// Halves round to the even neighbour: 2.5 becomes 2, 3.5 becomes 4
+	ROUND_HALF_EVEN
+	// Extra digits are dropped: 2.59 becomes 2.5, -2.59 becomes -2.5
+	ROUND_TRUNCATE
+)
+
+// How EDL rounds when it isn't told (e.g. number, currency and div)
+var DefaultRounding = ROUND_HALF_UP
+
+var ErrDivisionByZero = errors.New("Division by zero")
+
+var ten = big.NewInt(10)
+
+// Limits on what ParseDecimal accepts, so a value like "1e50000000" can't
+// take minutes to expand
+const (
+	maxDecimalExponent = 1000
+	maxDecimalDigits   = 400
+)
+
+// A Decimal is an exact decimal number of any size. EDL does its arithmetic
+// with them so amounts don't drift the way floats do. The zero value is 0.
+type Decimal struct {
+	// The value is unscaled / 10^scale
+	unscaled *big.Int
+	scale    int
+}
+
+// ParseDecimal parses a number like "-1234.5678" or "1.5e3"
+func ParseDecimal(s string) (Decimal, error) {
+	invalid := errors.New("Invalid decimal " + strconv.Quote(s))
+	s = strings.TrimSpace(s)
+
+	exp := 0
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		var err error
+		exp, err = strconv.Atoi(s[i+1:])
+		if err != nil || exp > maxDecimalExponent || exp < -maxDecimalExponent {
+			return Decimal{}, invalid
+		}
+		s = s[:i]
+	}
+
+	digits := s
+	scale := 0
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		digits = s[:i] + s[i+1:]
+		scale = len(s) - i - 1
+	}
+	unsigned := strings.TrimLeft(digits, "+-")
+	if len(unsigned) == 0 || len(digits)-len(unsigned) > 1 || strings.ContainsAny(unsigned, "+-") {
+		return Decimal{}, invalid
+	}
+
+	scale -= exp
+	width := len(unsigned)
+	if scale < 0 {
+		width -= scale
+	} else if scale > width {
+		width = scale
+	}
+	if width > maxDecimalDigits {
+		return Decimal{}, invalid
+	}
+
+	unscaled, ok := new(big.Int).SetString(digits, 10)
+	if !ok {
+		return Decimal{}, invalid
+	}
+	if scale < 0 {
+		// e.g. 1.5e3 is 15 * 10^2
+		return Decimal{unscaled.Mul(unscaled, pow10(-scale)), 0}, nil
+	}
+	return Decimal{unscaled, scale}, nil
+}
+
+// NewDecimal returns unscaled / 10^scale, e.g. NewDecimal(12345, 2) is 123.45
+func NewDecimal(unscaled int64, scale int) Decimal {
+	return Decimal{big.NewInt(unscaled), scale}
+}
+
+func (d Decimal) int() *big.Int {
+	if d.unscaled == nil {
+		return new(big.Int)
+	}
+	return d.unscaled
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(ten, big.NewInt(int64(n)), nil)
+}
+
+// The same value with the given scale. Only ever adds digits.
+func (d Decimal) withScale(scale int) Decimal {
+	if scale <= d.scale {
+		return d
+	}
+	return Decimal{new(big.Int).Mul(d.int(), pow10(scale-d.scale)), scale}
+}
+
+// Both at the larger scale of the two
+func align(a Decimal, b Decimal) (Decimal, Decimal) {
+	if a.scale < b.scale {
+		return a.withScale(b.scale), b
+	}
+	return a, b.withScale(a.scale)
+}
+
+func (d Decimal) Add(o Decimal) Decimal {
+	a, b := align(d, o)
+	return Decimal{new(big.Int).Add(a.int(), b.int()), a.scale}
+}
+
+func (d Decimal) Sub(o Decimal) Decimal {
+	a, b := align(d, o)
+	return Decimal{new(big.Int).Sub(a.int(), b.int()), a.scale}
+}
+
+func (d Decimal) Mul(o Decimal) Decimal {
+	return Decimal{new(big.Int).Mul(d.int(), o.int()), d.scale + o.scale}
+}
+
+// Div divides to the given number of decimal places, rounded with mode
+func (d Decimal) Div(o Decimal, places int, mode int) (Decimal, error) {
+	if o.Sign() == 0 {
+		return Decimal{}, ErrDivisionByZero
+	}
+	num := new(big.Int).Mul(d.int(), pow10(o.scale+places))
+	den := new(big.Int).Mul(o.int(), pow10(d.scale))
+	return Decimal{quo(num, den, mode), places}, nil
+}
+
+// Round rounds to the given number of decimal places with mode. Negative
+// places round to tens, hundreds and so on.
+func (d Decimal) Round(places int, mode int) Decimal {
+	if places >= d.scale {
+		return d
+	}
+	rounded := Decimal{quo(d.int(), pow10(d.scale-places), mode), places}
+	if places < 0 {
+		// e.g. 12 * 10^2 is 1200
+		return rounded.withScale(0)
+	}
+	return rounded
+}
+
+// Divides, rounding with mode
+func quo(num *big.Int, den *big.Int, mode int) *big.Int {
+	q, r := new(big.Int).QuoRem(num, den, new(big.Int))
+	if r.Sign() == 0 || mode == ROUND_TRUNCATE {
+		return q
+	}
+
+	// Compare the remainder with half the divisor
+	half := new(big.Int).Abs(r)
+	half.Mul(half, big.NewInt(2))
+	cmp := half.Cmp(new(big.Int).Abs(den))
+	if cmp > 0 || (cmp == 0 && (mode == ROUND_HALF_UP || q.Bit(0) == 1)) {
+		if num.Sign()*den.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q
+}
+
+// Cmp returns -1, 0 or 1 as d is less than, equal to or greater than o
+func (d Decimal) Cmp(o Decimal) int {
+	a, b := align(d, o)
+	return a.int().Cmp(b.int())
+}
+
+func (d Decimal) Sign() int {
+	return d.int().Sign()
+}
+
+func (d Decimal) Neg() Decimal {
+	return Decimal{new(big.Int).Neg(d.int()), d.scale}
+}
+
+// String returns the value without trailing zeros, e.g. "2.5" or "30"
+func (d Decimal) String() string {
+	s := d.format()
+	if d.scale > 0 {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	return s
+}
+
+// StringFixed returns the value rounded with mode to exactly the given
+// number of decimal places, e.g. "2.50"
+func (d Decimal) StringFixed(places int, mode int) string {
+	if places < 0 {
+		places = 0
+	}
+	return d.Round(places, mode).withScale(places).format()
+}
+
+func (d Decimal) format() string {
+	digits := new(big.Int).Abs(d.int()).String()
+	sign := ""
+	if d.Sign() < 0 {
+		sign = "-"
+	}
+	if d.scale <= 0 {
+		return sign + digits
+	}
+	if len(digits) <= d.scale {
+		digits = strings.Repeat("0", d.scale-len(digits)+1) + digits
+	}
+	point := len(digits) - d.scale
+	return sign + digits[:point] + "." + digits[point:]
+}
+
+func (d Decimal) Float64() float64 {
+	f, _ := strconv.ParseFloat(d.format(), 64)
+	return f
+}
+
+// Converts numbers, and strings that are numbers, to decimals. Floats are
+// taken as the shortest decimal that is the same float, so 0.1 is 0.1.
+func toDecimal(arg interface{}) (Decimal, error) {
+	switch n := arg.(type) {
+	case Decimal:
+		return n, nil
+	case *Decimal:
+		if n != nil {
+			return *n, nil
+		}
+	case string:
+		return ParseDecimal(n)
+	case int:
+		return NewDecimal(int64(n), 0), nil
+	case int8:
+		return NewDecimal(int64(n), 0), nil
+	case int16:
+		return NewDecimal(int64(n), 0), nil
+	case int32:
+		return NewDecimal(int64(n), 0), nil
+	case int64:
+		return NewDecimal(n, 0), nil
+	case uint:
+		return Decimal{new(big.Int).SetUint64(uint64(n)), 0}, nil
+	case uint8:
+		return NewDecimal(int64(n), 0), nil
+	case uint16:
+		return NewDecimal(int64(n), 0), nil
+	case uint32:
+		return NewDecimal(int64(n), 0), nil
+	case uint64:
+		return Decimal{new(big.Int).SetUint64(n), 0}, nil
+	case float32:
+		return ParseDecimal(strconv.FormatFloat(float64(n), 'f', -1, 32))
+	case float64:
+		return ParseDecimal(strconv.FormatFloat(n, 'f', -1, 64))
+	}
+	return Decimal{}, errors.New("Invalid number " + toString(arg))
+}
+
+// Missing values, and anything else that isn't a number (e.g. "N/A"), count
+// as zero in arithmetic
+func toDecimalOrZero(arg interface{}) Decimal {
+	d, err := toDecimal(arg)
+	if err != nil {
+		return Decimal{}
+	}
+	return d
+}
+
+func isDecimal(arg interface{}) bool {
+	switch arg.(type) {
+	case Decimal, *Decimal:
+		return true
+	}
+	return false
+}
+
+// Numbers of any kind (not strings)
+func isNumber(arg interface{}) bool {
+	if isDecimal(arg) {
+		return true
+	}
+	k, err := basicKind(reflect.ValueOf(arg))
+	return err == nil && (k == intKind || k == uintKind || k == floatKind)
+}
+
+func isNumeric(arg interface{}) bool {
+	if s, ok := arg.(string); ok {
+		_, err := ParseDecimal(s)
+		return err == nil
+	}
+	return isNumber(arg)
+}
+
+// Works out whether two values are to be compared as decimals. They are if
+// either one is a decimal, in which case the other must be a number or a
+// string that parses as one. They are also if one is a number and the other
+// is a number of another kind or a string that parses as one, so 10 equals
+// 10.0 and "10". Two strings are compared as strings.
+func toDecimals(arg1 interface{}, arg2 interface{}) (Decimal, Decimal, bool, error) {
+	mixed := false
+	if n1, n2 := isNumber(arg1), isNumber(arg2); n1 && n2 {
+		k1, _ := basicKind(reflect.ValueOf(arg1))
+		k2, _ := basicKind(reflect.ValueOf(arg2))
+		mixed = k1 != k2
+	} else if n1 || n2 {
+		mixed = isNumeric(arg1) && isNumeric(arg2)
+	}
+	if !isDecimal(arg1) && !isDecimal(arg2) && !mixed {
+		return Decimal{}, Decimal{}, false, nil
+	}
+	d1, err := toDecimal(arg1)
+	if err != nil {
+		return d1, d1, true, err
+	}
+	d2, err := toDecimal(arg2)
+	return d1, d2, true, err
+}
+
+// Reads a rounding mode given to an EDL function, either as one of the
+// constants or by name: "halfUp", "halfEven" or "truncate"
+func toRounding(arg interface{}) (int, error) {
+	switch arg {
+	case "halfUp", ROUND_HALF_UP:
+		return ROUND_HALF_UP, nil
+	case "halfEven", ROUND_HALF_EVEN:
+		return ROUND_HALF_EVEN, nil
+	case "truncate", ROUND_TRUNCATE:
+		return ROUND_TRUNCATE, nil
+	}
+	return 0, errors.New("Invalid rounding mode " + toString(arg))
+}
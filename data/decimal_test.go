@@ -0,0 +1,129 @@
+package data
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+	"time"
+)
+
+func dec(s string) Decimal {
+	d, err := ParseDecimal(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func TestDecimal(t *testing.T) {
+	Convey("Decimal", t, func() {
+		Convey("Parses", func() {
+			for in, out := range map[string]string{
+				"0":        "0",
+				"-12.50":   "-12.5",
+				"+3":       "3",
+				".5":       "0.5",
+				"1.5e3":    "1500",
+				"25E-4":    "0.0025",
+				" 100.00 ": "100",
+				"123456789012345678901234567890.123456789": "123456789012345678901234567890.123456789",
+			} {
+				So(dec(in).String(), ShouldEqual, out)
+			}
+
+			for _, in := range []string{"", "abc", "1.2.3", "--1", "1-", "1e", "$5"} {
+				_, err := ParseDecimal(in)
+				So(err, ShouldNotEqual, nil)
+			}
+		})
+
+		Convey("Refuses huge exponents and widths quickly", func() {
+			start := time.Now()
+			for _, in := range []string{"1e50000000", "1e-50000000", "1e1001", "1e400", "1e-401", strings.Repeat("9", 401)} {
+				_, err := ParseDecimal(in)
+				So(err, ShouldNotEqual, nil)
+			}
+			So(time.Since(start), ShouldBeLessThan, time.Second)
+
+			So(dec("1e300").Cmp(dec("1e299").Mul(dec("10"))), ShouldEqual, 0)
+			So(dec("1.5e-300").String(), ShouldEqual, "0."+strings.Repeat("0", 299)+"15")
+
+			datum := &Datum{}
+			datum.SetSource(map[string]interface{}{"x": "1e50000000"}, "")
+			_, err := datum.GetE("{{eq .x 1}}", "")
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Adds exactly", func() {
+			So(dec("0.1").Add(dec("0.2")).String(), ShouldEqual, "0.3")
+
+			total := Decimal{}
+			for i := 0; i < 10000; i++ {
+				total = total.Add(dec("19.99"))
+			}
+			So(total.String(), ShouldEqual, "199900")
+		})
+
+		Convey("Does arithmetic", func() {
+			So(dec("10").Sub(dec("0.01")).String(), ShouldEqual, "9.99")
+			So(dec("-1.5").Mul(dec("2.25")).String(), ShouldEqual, "-3.375")
+
+			q, err := dec("10").Div(dec("3"), 4, ROUND_HALF_UP)
+			So(err, ShouldEqual, nil)
+			So(q.String(), ShouldEqual, "3.3333")
+
+			q, _ = dec("-2").Div(dec("3"), 2, ROUND_HALF_UP)
+			So(q.String(), ShouldEqual, "-0.67")
+
+			_, err = dec("1").Div(Decimal{}, 2, ROUND_HALF_UP)
+			So(err, ShouldEqual, ErrDivisionByZero)
+		})
+
+		Convey("Rounds", func() {
+			cases := []struct {
+				in     string
+				places int
+				mode   int
+				out    string
+			}{
+				{"2.5", 0, ROUND_HALF_UP, "3"},
+				{"-2.5", 0, ROUND_HALF_UP, "-3"},
+				{"2.5", 0, ROUND_HALF_EVEN, "2"},
+				{"3.5", 0, ROUND_HALF_EVEN, "4"},
+				{"-2.5", 0, ROUND_HALF_EVEN, "-2"},
+				{"2.51", 0, ROUND_HALF_EVEN, "3"},
+				{"2.59", 1, ROUND_TRUNCATE, "2.5"},
+				{"-2.59", 1, ROUND_TRUNCATE, "-2.5"},
+				{"1.005", 2, ROUND_HALF_UP, "1.01"},
+				{"1.005", 2, ROUND_HALF_EVEN, "1"},
+				{"1.2", 4, ROUND_HALF_UP, "1.2"},
+				{"1234", -2, ROUND_HALF_UP, "1200"},
+				{"1250", -2, ROUND_HALF_EVEN, "1200"},
+				{"-1239.5", -1, ROUND_TRUNCATE, "-1230"},
+			}
+			for _, c := range cases {
+				So(dec(c.in).Round(c.places, c.mode).String(), ShouldEqual, c.out)
+			}
+		})
+
+		Convey("Formats to a fixed number of places", func() {
+			So(dec("1.5").StringFixed(2, ROUND_HALF_UP), ShouldEqual, "1.50")
+			So(dec("-0.005").StringFixed(2, ROUND_HALF_UP), ShouldEqual, "-0.01")
+			So(dec("0.004").StringFixed(2, ROUND_HALF_UP), ShouldEqual, "0.00")
+			So(dec("17.5").StringFixed(0, ROUND_HALF_EVEN), ShouldEqual, "18")
+		})
+
+		Convey("Compares", func() {
+			So(dec("1.50").Cmp(dec("1.5")), ShouldEqual, 0)
+			So(dec("-1").Cmp(dec("0.5")), ShouldEqual, -1)
+			So(Decimal{}.Cmp(dec("-0.0001")), ShouldEqual, 1)
+		})
+
+		Convey("Converts floats to the shortest decimal", func() {
+			d, err := toDecimal(0.1)
+			So(err, ShouldEqual, nil)
+			So(d.String(), ShouldEqual, "0.1")
+			So(dec("2.5").Float64(), ShouldEqual, 2.5)
+		})
+	})
+}
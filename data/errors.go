@@ -0,0 +1,92 @@
+package data
+
+import (
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// An EvalError is a key that couldn't be parsed or evaluated
+type EvalError struct {
+	Key string
+	// Where in the key the problem is, counting from 1. Col is 0 if it isn't
+	// known, which is usually the case for parse errors.
+	Line int
+	Col  int
+	// The function that failed, if it was a function
+	Func string
+	// What went wrong, without the position
+	Message string
+	// The error from the template engine
+	Err error
+}
+
+func (e *EvalError) Error() string {
+	pos := "line " + strconv.Itoa(e.Line)
+	if e.Col > 0 {
+		pos += ", col " + strconv.Itoa(e.Col)
+	}
+	if len(e.Func) > 0 {
+		pos += " (" + e.Func + ")"
+	}
+	return "EDL error in " + strconv.Quote(e.Key) + " at " + pos + ": " + e.Message
+}
+
+func (e *EvalError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	// e.g. `template: tmpl:1:6: executing "tmpl" at <gt .a 1>: error calling gt: ...`
+	// or `template: tmpl:1: function "foo" not defined`
+	templateErrorPattern = regexp.MustCompile(`^template: tmpl:(\d+)(?::(\d+))?: (.*)$`)
+	executingPattern     = regexp.MustCompile(`^executing "tmpl" at <.*?>: (.*)$`)
+	callingPattern       = regexp.MustCompile(`^error calling (\S+): (.*)$`)
+	undefinedPattern     = regexp.MustCompile(`^function "(\S+)" not defined$`)
+)
+
+// Picks apart an error from the template engine. The engine only has
+// errors with messages, so that's what this goes by.
+func newEvalError(key string, err error) *EvalError {
+	e := &EvalError{Key: key, Message: err.Error(), Err: err}
+
+	match := templateErrorPattern.FindStringSubmatch(err.Error())
+	if match == nil {
+		return e
+	}
+	e.Line, _ = strconv.Atoi(match[1])
+	if len(match[2]) > 0 {
+		// The engine counts columns from 0
+		col, _ := strconv.Atoi(match[2])
+		e.Col = col + 1
+	}
+	e.Message = match[3]
+
+	if match = executingPattern.FindStringSubmatch(e.Message); match != nil {
+		e.Message = match[1]
+	}
+	if match = callingPattern.FindStringSubmatch(e.Message); match != nil {
+		e.Func = match[1]
+		e.Message = match[2]
+	} else if match = undefinedPattern.FindStringSubmatch(e.Message); match != nil {
+		e.Func = match[1]
+	}
+	e.Message = strings.TrimSpace(e.Message)
+	return e
+}
+
+// Whether err came from a strict run looking up a key that isn't there
+func isMissingKey(err error) bool {
+	evalErr, ok := err.(*EvalError)
+	return ok && strings.HasPrefix(evalErr.Message, "map has no entry for key")
+}
+
+// A SourceError is a datum source that isn't a map or struct
+type SourceError struct {
+	Kind reflect.Kind
+}
+
+func (s *SourceError) Error() string {
+	return "Invalid type for emissary datum source (" + s.Kind.String() + ")"
+}
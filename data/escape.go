@@ -0,0 +1,135 @@
+package data
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// Escaping modes for the values that EDL prints. Only the values are escaped,
+// never the text around them in the key, except by ESCAPE_CSV.
+const (
+	// Whatever the datum (or, for a datum, ESCAPE_NONE) says
+	ESCAPE_DEFAULT = iota
+	ESCAPE_NONE
+	ESCAPE_HTML
+	ESCAPE_XML
+	// Stops spreadsheet programs from running a cell as a formula by
+	// putting a ' in front of the whole result if it starts with =, +, -, @,
+	// a tab or a carriage return and isn't a number. The CSV writer takes
+	// care of quoting.
+	ESCAPE_CSV
+)
+
+// An EscapeGetter is a Getter that can escape values other than the way it
+// does by default
+type EscapeGetter interface {
+	Getter
+	GetEscaped(key string, defaultValue string, mode int) string
+}
+
+// The function that every action in a key is piped through
+const escapeFunc = "_escape"
+
+var xmlReplacer = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+	`"`, "&quot;",
+	"'", "&apos;",
+)
+
+// Returns the function that prints a value in the given mode. Missing values
+// (including nil pointers) print as nothing rather than "<no value>", and
+// other pointers print what they point to, as the template engine does.
+func escaper(mode int) func(...interface{}) string {
+	return func(args ...interface{}) string {
+		if len(args) == 0 {
+			return ""
+		}
+		val := indirect(args[len(args)-1])
+		if val == nil {
+			return ""
+		}
+		return escape(fmt.Sprint(val), mode)
+	}
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// Follows pointers, unless they're Stringers or errors, which print
+// themselves. A nil pointer is nil.
+func indirect(v interface{}) interface{} {
+	value := reflect.ValueOf(v)
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return nil
+		}
+		if value.Type().Implements(stringerType) || value.Type().Implements(errorType) {
+			break
+		}
+		value = value.Elem()
+	}
+	if !value.IsValid() {
+		return nil
+	}
+	return value.Interface()
+}
+
+func escape(val string, mode int) string {
+	switch mode {
+	case ESCAPE_HTML:
+		return template.HTMLEscapeString(val)
+	case ESCAPE_XML:
+		return xmlReplacer.Replace(val)
+	}
+	return val
+}
+
+// Escapes the whole result of a key. Only ESCAPE_CSV works on the result
+// rather than on each value, as it's the start of the cell that matters.
+func escapeResult(val string, mode int) string {
+	if mode != ESCAPE_CSV || len(val) == 0 || !strings.ContainsAny(val[:1], "=+-@\t\r") {
+		return val
+	}
+	if strings.ContainsAny(val[:1], "+-") && strings.TrimSpace(val) == val {
+		if _, err := ParseDecimal(val); err == nil {
+			return val
+		}
+	}
+	return "'" + val
+}
+
+// Pipes the result of every action that prints something through
+// escapeFunc, the same way html/template adds its escapers
+func addEscaper(node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			addEscaper(child)
+		}
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) > 0 {
+			return
+		}
+		n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{
+			NodeType: parse.NodeCommand,
+			Pos:      n.Pos,
+			Args:     []parse.Node{parse.NewIdentifier(escapeFunc).SetPos(n.Pos)},
+		})
+	case *parse.IfNode:
+		addEscaper(n.List)
+		addEscaper(n.ElseList)
+	case *parse.RangeNode:
+		addEscaper(n.List)
+		addEscaper(n.ElseList)
+	case *parse.WithNode:
+		addEscaper(n.List)
+		addEscaper(n.ElseList)
+	}
+}
@@ -0,0 +1,260 @@
+package data
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+	"text/template"
+	"text/template/parse"
+)
+
+// Most compiled expressions kept by Compile. Set it before using EDL.
+var ExprCacheSize = 4096
+
+// An Expr is a compiled EDL key. It's safe to evaluate from several
+// goroutines at once.
+type Expr struct {
+	*compiled
+	mode      int
+	defaultOn int
+	lookups   *boundLookups
+}
+
+// The parsed key, shared by every Expr compiled from it
+type compiled struct {
+	key  string
+	tmpl *template.Template
+
+	// Copies of tmpl that escape with each mode, made as they're needed. The
+	// strict ones fail on missing map keys.
+	lock    sync.Mutex
+	escaped [ESCAPE_CSV + 1]*template.Template
+	strict  [ESCAPE_CSV + 1]*template.Template
+
+	// For typed values (see Value)
+	captured *parse.Tree
+	captures capturePools
+}
+
+// Compile parses an EDL key once so it can be evaluated many times. Values
+// are escaped the way the datum it is evaluated with says (see Datum.Eval),
+// or not at all when it is evaluated with Expr.Eval.
+func Compile(key string) (*Expr, error) {
+	return CompileEscaped(key, ESCAPE_DEFAULT)
+}
+
+// CompileEscaped is the same as Compile, but always escapes values with the
+// given mode. Errors are *EvalErrors.
+func CompileEscaped(key string, mode int) (*Expr, error) {
+	c, err := exprCache.get(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Expr{c, mode, 0, nil}, nil
+}
+
+// WithDefaultOn returns a copy of the expression that falls back to its
+// default in the given cases (see the DEFAULT_ON constants) instead of the
+// datum's
+func (e *Expr) WithDefaultOn(when int) *Expr {
+	copied := *e
+	copied.defaultOn = when
+	return &copied
+}
+
+// WithLookups returns a copy of the expression whose lookup function uses the
+// given tables
+func (e *Expr) WithLookups(lookups Lookups) *Expr {
+	copied := *e
+	copied.lookups = &boundLookups{lookups: lookups}
+	return &copied
+}
+
+// Key returns the EDL the expression was compiled from
+func (e *Expr) Key() string {
+	return e.key
+}
+
+// Eval evaluates the expression against src, which is usually a map (see
+// Datum.SetSource). Errors are *EvalErrors.
+func (e *Expr) Eval(src interface{}) (string, error) {
+	return e.eval(src, e.mode)
+}
+
+// EvalValue is the same as Eval, but returns a typed value (see Value)
+func (e *Expr) EvalValue(src interface{}) (Value, error) {
+	return e.value(src, e.mode, false)
+}
+
+// Evaluates with the expression's own mode if it has one, and mode otherwise
+func (e *Expr) eval(src interface{}, mode int) (string, error) {
+	return e.execute(src, mode, false)
+}
+
+func (e *Expr) evalDefault(src interface{}, def *Expr, mode int, when int) (string, error) {
+	val, err := e.fallback(def, when, func(expr *Expr, strict bool) (Value, error) {
+		text, err := expr.execute(src, mode, strict)
+		return Value{VALUE_STRING, text, text}, err
+	})
+	return val.text, err
+}
+
+func (e *Expr) evalValueDefault(src interface{}, def *Expr, mode int, when int) (Value, error) {
+	return e.fallback(def, when, func(expr *Expr, strict bool) (Value, error) {
+		return expr.value(src, mode, strict)
+	})
+}
+
+// Falls back to def as when says (or as the expression says, if it has its
+// own). The default is only used if it isn't empty, and is evaluated the
+// same way.
+func (e *Expr) fallback(def *Expr, when int, eval func(expr *Expr, strict bool) (Value, error)) (Value, error) {
+	if def == nil || len(def.key) == 0 {
+		return eval(e, false)
+	}
+	if e.defaultOn != 0 {
+		when = e.defaultOn
+	}
+	if when == 0 {
+		when = DEFAULT_ON_ALL
+	}
+
+	// A strict run tells missing keys apart. If nothing is missing, the
+	// result is the same as a normal run.
+	val, err := eval(e, when&DEFAULT_ON_MISSING != 0)
+	if err != nil {
+		if isMissingKey(err) || when&DEFAULT_ON_ERROR != 0 {
+			return eval(def, false)
+		}
+		return Value{}, err
+	}
+	if len(val.text) == 0 && when&DEFAULT_ON_EMPTY != 0 {
+		return eval(def, false)
+	}
+	return val, nil
+}
+
+// The expression's own mode if it has one, and mode otherwise
+func (e *Expr) escapeMode(mode int) int {
+	if e.mode != ESCAPE_DEFAULT {
+		mode = e.mode
+	}
+	if mode < ESCAPE_NONE || mode > ESCAPE_CSV {
+		mode = ESCAPE_NONE
+	}
+	return mode
+}
+
+func (e *Expr) execute(src interface{}, mode int, strict bool) (string, error) {
+	mode = e.escapeMode(mode)
+
+	tmpl := e.template(mode, strict)
+	if e.lookups != nil {
+		tmpl = e.lookups.template(e.compiled, mode, strict)
+	}
+
+	buf := &bytes.Buffer{}
+	err := tmpl.Execute(buf, src)
+	if err != nil {
+		return "", newEvalError(e.key, err)
+	}
+	return escapeResult(buf.String(), mode), nil
+}
+
+func (c *compiled) template(mode int, strict bool) *template.Template {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.escaped[mode] == nil {
+		// The parse tree is shared; only the functions and options differ
+		tmpl, _ := c.tmpl.Clone()
+		c.escaped[mode] = tmpl.Funcs(template.FuncMap{escapeFunc: escaper(mode)})
+		c.strict[mode], _ = c.escaped[mode].Clone()
+		c.strict[mode].Option("missingkey=error")
+	}
+	if strict {
+		return c.strict[mode]
+	}
+	return c.escaped[mode]
+}
+
+// Copies of an expression's templates with lookup tables bound to them, made
+// as they're needed
+type boundLookups struct {
+	lookups Lookups
+
+	lock     sync.Mutex
+	escaped  [ESCAPE_CSV + 1]*template.Template
+	strict   [ESCAPE_CSV + 1]*template.Template
+	captures capturePools
+}
+
+func (b *boundLookups) template(c *compiled, mode int, strict bool) *template.Template {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.escaped[mode] == nil {
+		funcs := template.FuncMap{"lookup": b.lookups.lookup}
+		b.escaped[mode], _ = c.template(mode, false).Clone()
+		b.escaped[mode].Funcs(funcs)
+		b.strict[mode], _ = c.template(mode, true).Clone()
+		b.strict[mode].Funcs(funcs)
+	}
+	if strict {
+		return b.strict[mode]
+	}
+	return b.escaped[mode]
+}
+
+func compile(key string) (*compiled, error) {
+	tmpl, err := parseKey(key)
+	if err != nil {
+		return nil, newEvalError(key, err)
+	}
+	captured := captureTree(tmpl.Tree)
+	addEscaper(tmpl.Tree.Root)
+	return &compiled{key: key, tmpl: tmpl, captured: captured}, nil
+}
+
+var exprCache = &lruCache{
+	entries: make(map[string]*list.Element),
+	order:   list.New(),
+}
+
+// Compiled keys, least recently used first out
+type lruCache struct {
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+func (l *lruCache) get(key string) (*compiled, error) {
+	l.lock.Lock()
+	if elem, ok := l.entries[key]; ok {
+		l.order.MoveToFront(elem)
+		l.lock.Unlock()
+		return elem.Value.(*compiled), nil
+	}
+	l.lock.Unlock()
+
+	// Parse outside the lock. Two goroutines might both parse the same key,
+	// which is harmless.
+	c, err := compile(key)
+	if err != nil {
+		return nil, err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if elem, ok := l.entries[key]; ok {
+		l.order.MoveToFront(elem)
+		return elem.Value.(*compiled), nil
+	}
+	l.entries[key] = l.order.PushFront(c)
+	for l.order.Len() > ExprCacheSize && l.order.Len() > 0 {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.entries, oldest.Value.(*compiled).key)
+	}
+	return c, nil
+}
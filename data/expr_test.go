@@ -0,0 +1,161 @@
+package data
+
+import (
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"sync"
+	"testing"
+)
+
+func TestExpr(t *testing.T) {
+	Convey("Compiled expressions", t, func() {
+		Convey("Evaluate like Get", func() {
+			expr, err := Compile("{{(add (mult .a .b.c) .d 3)}} {{.n}}")
+			So(err, ShouldEqual, nil)
+			So(expr.Key(), ShouldEqual, "{{(add (mult .a .b.c) .d 3)}} {{.n}}")
+
+			val, err := expr.Eval(dm)
+			So(err, ShouldEqual, nil)
+			So(val, ShouldEqual, "30 AT&T")
+		})
+
+		Convey("Return parse errors", func() {
+			_, err := Compile("{{.a")
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Return execution errors", func() {
+			expr, err := Compile("{{.a.b}}")
+			So(err, ShouldEqual, nil)
+			_, err = expr.Eval(dm)
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Escape with their own mode, or else the datum's", func() {
+			datum := &Datum{Escape: ESCAPE_XML}
+			datum.SetSource(dm, "")
+
+			expr, _ := Compile("{{.o}}")
+			So(datum.Eval(expr, nil), ShouldEqual, "O&apos;Brien &lt;o@example.com&gt;")
+			val, _ := expr.Eval(dm)
+			So(val, ShouldEqual, "O'Brien <o@example.com>")
+
+			expr, _ = CompileEscaped("{{.o}}", ESCAPE_HTML)
+			So(datum.Eval(expr, nil), ShouldEqual, "O&#39;Brien &lt;o@example.com&gt;")
+		})
+
+		Convey("Look up values in the tables they're given", func() {
+			lookups := Lookups{
+				"plans": {
+					"10":  "PPO-A",
+					"bar": map[string]interface{}{"carrierCode": "HMO-B"},
+				},
+			}
+			expr, _ := Compile(`{{lookup "plans" .a}} {{(lookup "plans" .e).carrierCode}} {{lookup "plans" .d "none"}}`)
+			val, err := expr.WithLookups(lookups).Eval(dm)
+			So(err, ShouldEqual, nil)
+			So(val, ShouldEqual, "PPO-A HMO-B none")
+
+			_, err = expr.Eval(dm)
+			So(err, ShouldNotEqual, nil)
+
+			expr, _ = Compile(`{{lookup "codes" .a}}`)
+			_, err = expr.WithLookups(lookups).Eval(dm)
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Are cached", func() {
+			first, _ := Compile("{{.e}} cached")
+			second, _ := CompileEscaped("{{.e}} cached", ESCAPE_HTML)
+			So(first.compiled, ShouldEqual, second.compiled)
+		})
+
+		Convey("Drop the least recently used", func() {
+			size := ExprCacheSize
+			ExprCacheSize = 2
+			defer func() {
+				ExprCacheSize = size
+			}()
+
+			first, _ := Compile("{{.a}} lru")
+			Compile("{{.d}} lru")
+			Compile("{{.a}} lru")
+			Compile("{{.e}} lru")
+
+			again, _ := Compile("{{.a}} lru")
+			So(again.compiled, ShouldEqual, first.compiled)
+			So(exprCache.order.Len(), ShouldEqual, 2)
+			_, ok := exprCache.entries["{{.d}} lru"]
+			So(ok, ShouldEqual, false)
+		})
+
+		Convey("Can be evaluated concurrently", func() {
+			expr, _ := Compile("{{.e}}-{{.f.g}}")
+			var wg sync.WaitGroup
+			results := make([]string, 20)
+			for i := range results {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					datum := &Datum{Escape: i%3 + ESCAPE_NONE}
+					datum.SetSource(dm, "")
+					results[i] = datum.Eval(expr, nil)
+				}(i)
+			}
+			wg.Wait()
+			for _, result := range results {
+				So(result, ShouldEqual, "bar-boop")
+			}
+		})
+	})
+}
+
+var benchKey = `{{if (gt .a 9)}}{{currency (add (mult .a .b.c) .d)}}{{else}}{{substring .e 2}}{{end}}`
+
+// What Get used to do for every call
+func BenchmarkParse(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		c, err := compile(benchKey)
+		if err != nil {
+			b.Fatal(err)
+		}
+		c.tmpl.Execute(&discard{}, dm)
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	datum := &Datum{}
+	datum.SetSource(dm, "")
+	for i := 0; i < b.N; i++ {
+		datum.Get(benchKey, "")
+	}
+}
+
+func BenchmarkEval(b *testing.B) {
+	datum := &Datum{}
+	datum.SetSource(dm, "")
+	expr, _ := Compile(benchKey)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		datum.Eval(expr, nil)
+	}
+}
+
+func BenchmarkGetManyKeys(b *testing.B) {
+	datum := &Datum{}
+	datum.SetSource(dm, "")
+	keys := make([]string, 40)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("{{.e}} %d", i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		datum.Get(keys[i%len(keys)], "")
+	}
+}
+
+type discard struct{}
+
+func (d *discard) Write(p []byte) (int, error) {
+	return len(p), nil
+}
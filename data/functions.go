@@ -2,13 +2,10 @@ package data
 
 import (
 	"errors"
-	"fmt"
-	"github.com/dustin/go-humanize"
-	"html/template"
 	"math"
 	"reflect"
-	"strconv"
 	"strings"
+	"text/template"
 	"time"
 )
 
@@ -63,117 +60,141 @@ func basicKind(v reflect.Value) (kind, error) {
 	return invalidKind, errBadComparisonType
 }
 
-func parseFloat(arg interface{}) (float64, error) {
-	switch arg.(type) {
-	case string:
-		return strconv.ParseFloat(arg.(string), 64)
-	case int:
-		f := arg.(int)
-		return float64(f), nil
-	case int32:
-		f := arg.(int32)
-		return float64(f), nil
-	case int64:
-		f := arg.(int64)
-		return float64(f), nil
-	case float32:
-		f := arg.(float32)
-		return float64(f), nil
-	case float64:
-		f := arg.(float64)
-		return f, nil
-	default:
-		return 0.0, errors.New("Invalid float")
-
-	}
-}
-
 // MATH FUNCTIONS
+//
+// These work on exact decimals (see Decimal). Missing values, and values
+// that aren't numbers, count as zero.
 
-func add(args ...interface{}) string {
-	total := 0.0
+func add(args ...interface{}) Decimal {
+	total := Decimal{}
 	for _, arg := range args {
-		f, _ := parseFloat(arg)
-		total += f
+		total = total.Add(toDecimalOrZero(arg))
 	}
 
-	return fmt.Sprint(total)
+	return total
 }
 
-func sub(args ...interface{}) string {
-	total := 0.0
+func sub(args ...interface{}) Decimal {
+	total := Decimal{}
 	for i, arg := range args {
-		f, _ := parseFloat(arg)
+		d := toDecimalOrZero(arg)
 		if i == 0 {
-			total = f
+			total = d
 		} else {
-			total -= f
+			total = total.Sub(d)
 		}
 
 	}
 
-	return fmt.Sprint(total)
+	return total
 }
 
-func mult(args ...interface{}) string {
-	total := 1.0
+func mult(args ...interface{}) Decimal {
+	total := NewDecimal(1, 0)
 	for _, arg := range args {
-		f, _ := parseFloat(arg)
-		total *= f
+		total = total.Mul(toDecimalOrZero(arg))
 	}
 
-	return fmt.Sprint(total)
+	return total
 }
 
-func div(args ...interface{}) string {
-	total := 0.0
+// Each division is to DefaultDecimalCount places, rounded with
+// DefaultRounding
+func div(args ...interface{}) (Decimal, error) {
+	var err error
+	total := Decimal{}
 	for i, arg := range args {
-		f, _ := parseFloat(arg)
+		d := toDecimalOrZero(arg)
 
 		if i == 0 {
-			total = f
+			total = d
 		} else {
-			total = total / f
+			total, err = total.Div(d, DefaultDecimalCount, DefaultRounding)
+			if err != nil {
+				return total, err
+			}
 		}
 
 	}
 
-	return fmt.Sprint(total)
+	return total, nil
 }
 
-// FORMATTERS
-func currency(args ...interface{}) string {
-	arg := args[0]
+// Rounds to a number of decimal places, with DefaultRounding or the mode
+// given as the third argument
+func round(args ...interface{}) (Decimal, error) {
+	d, places, mode, err := roundingArgs(args, 1)
+	if err != nil {
+		return d, err
+	}
+	return d.Round(places, mode), nil
+}
 
-	input := fmt.Sprint(arg)
+// Reads (value, places, mode) arguments, where places and mode are optional
+// and there are at least required of them
+func roundingArgs(args []interface{}, required int) (Decimal, int, int, error) {
+	if len(args) < required || len(args) > 3 {
+		return Decimal{}, 0, 0, errors.New("Expected a number, optionally the decimal places and optionally a rounding mode")
+	}
+	d, err := toDecimal(args[0])
+	if err != nil {
+		return d, 0, 0, err
+	}
 
-	spl := strings.Split(input, ".")
-	intval := spl[0]
-	if len(spl) == 1 {
-		spl = append(spl, "00")
+	places := 0
+	if len(args) >= 2 {
+		places, err = toInt(args[1])
+		if err != nil {
+			return d, 0, 0, err
+		}
 	}
 
-	// Parse the int
-	ival, err := strconv.ParseInt(intval, 10, 64)
+	mode := DefaultRounding
+	if len(args) == 3 {
+		mode, err = toRounding(args[2])
+	}
+	return d, places, mode, err
+}
+
+// FORMATTERS
+
+// Formats as dollars and cents, rounded with DefaultRounding or the mode
+// given as the second argument. Anything that isn't a number is left alone.
+func currency(args ...interface{}) (string, error) {
+	if len(args) == 0 || len(args) > 2 {
+		return "", errors.New("currency requires a number and optionally a rounding mode")
+	}
+	arg := args[0]
+
+	d, err := toDecimal(arg)
 	if err != nil {
-		return input
+		return toString(arg), nil
 	}
-	intval = humanize.Comma(ival)
 
-	dec := spl[1]
-	parsed, _ := strconv.ParseFloat("."+dec, 64)
+	mode := DefaultRounding
+	if len(args) == 2 {
+		mode, err = toRounding(args[1])
+		if err != nil {
+			return "", err
+		}
+	}
 
-	var decval string
-	if parsed == 0 {
-		decval = ".00"
-	} else {
-		decval = fmt.Sprint(Round(parsed, .5, 2))[1:]
+	fixed := d.StringFixed(2, mode)
+	sign := ""
+	if strings.HasPrefix(fixed, "-") {
+		sign = "-"
+		fixed = fixed[1:]
 	}
+	point := strings.IndexByte(fixed, '.')
+	return "$" + sign + commas(fixed[:point]) + fixed[point:], nil
+}
 
-	if len(decval) == 2 {
-		decval = decval + "0"
+// Puts commas between thousands, e.g. 1234567 becomes 1,234,567
+func commas(digits string) string {
+	for i := len(digits) - 3; i > 0; i -= 3 {
+		digits = digits[:i] + "," + digits[i:]
 	}
-	return "$" + intval + decval
+	return digits
 }
 
 func substring(args ...interface{}) (string, error) {
@@ -209,9 +230,8 @@ func date(args ...interface{}) string {
 
 	arg := args[0]
 
-	var dateval time.Time
-	var ok bool
-	if dateval, ok = arg.(time.Time); !ok {
+	dateval, err := toTime(arg)
+	if err != nil {
 		return "Invalid Date"
 	}
 
@@ -226,69 +246,59 @@ func date(args ...interface{}) string {
 	return dateval.Format(format)
 }
 
+// Formats to a number of decimal places (none by default), rounded with
+// DefaultRounding or the mode given as the third argument
 func number(args ...interface{}) (string, error) {
 	if len(args) == 0 {
 		return "", errors.New("Not enough arguments for number")
 	}
 
-	arg1, err := parseFloat(args[0])
+	d, places, mode, err := roundingArgs(args, 1)
 	if err != nil {
 		return "", err
 	}
+	return d.StringFixed(places, mode), nil
+}
 
-	// Round to decimal places
-	var round int
-	if len(args) < 1 {
-		round = 0
-	} else {
-		arg2, err := parseFloat(args[1])
-		if err != nil {
-			return "", err
-		}
+// COMPARATORS
 
-		round = int(arg2)
+func eq(arg1 interface{}, arg2 ...interface{}) (bool, error) {
+	if len(arg2) == 0 {
+		return false, errNoComparison
 	}
 
-	parsed := Round(arg1, .5, round)
-
-	format := fmt.Sprintf("%d", round)
-	return fmt.Sprintf("%."+format+"f", parsed), nil
-}
+	// Equal to any of them
+	if len(arg2) > 1 {
+		for _, arg := range arg2 {
+			equal, err := eq(arg1, arg)
+			if equal || err != nil {
+				return equal, err
+			}
+		}
+		return false, nil
+	}
 
-// COMPARATORS
+	// Nothing is only equal to nothing
+	if arg1 == nil || arg2[0] == nil {
+		return arg1 == nil && arg2[0] == nil, nil
+	}
 
-func eq(arg1 interface{}, arg2 ...interface{}) (bool, error) {
-	// Addition - if arg1 and arg2 are both time.Time
-	var t1 time.Time
-	var t2 time.Time
-	foundT1 := false
-	foundT2 := false
-	var err error
-	if t, ok := arg1.(time.Time); ok {
-		t1 = t
-		foundT1 = true
-	} else if t, ok := arg1.(GetTime); ok {
-		t1, err = t.GetTime()
+	// Addition - if either is a date, compare them as dates
+	t1, t2, isTime, err := toTimes(arg1, arg2[0])
+	if isTime {
 		if err != nil {
 			return false, err
 		}
-		foundT1 = true
+		return t1.Equal(t2), nil
 	}
-	if t, ok := arg2[0].(time.Time); ok {
-		t2 = t
-		foundT2 = true
-	} else if t, ok := arg2[0].(GetTime); ok {
-		t2, err = t.GetTime()
+
+	// And the same for decimals
+	d1, d2, isDecimal, err := toDecimals(arg1, arg2[0])
+	if isDecimal {
 		if err != nil {
 			return false, err
 		}
-		foundT2 = true
-	}
-
-	if foundT1 && foundT2 {
-		return t1 == t2, nil
-	} else if foundT1 || foundT2 {
-		return false, errors.New("Cannot compare date with non-date")
+		return d1.Cmp(d2) == 0, nil
 	}
 
 	v1 := reflect.ValueOf(arg1)
@@ -296,9 +306,6 @@ func eq(arg1 interface{}, arg2 ...interface{}) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	if len(arg2) == 0 {
-		return false, errNoComparison
-	}
 	for _, arg := range arg2 {
 		v2 := reflect.ValueOf(arg)
 		k2, err := basicKind(v2)
@@ -352,37 +359,27 @@ type GetTime interface {
 }
 
 func lt(arg1 interface{}, arg2 interface{}) (bool, error) {
-	// Addition - if arg1 and arg2 are both time.Time
-	var t1 time.Time
-	var t2 time.Time
-	foundT1 := false
-	foundT2 := false
-	var err error
-	if t, ok := arg1.(time.Time); ok {
-		t1 = t
-		foundT1 = true
-	} else if t, ok := arg1.(GetTime); ok {
-		t1, err = t.GetTime()
+	// Nothing is less than anything else
+	if arg1 == nil || arg2 == nil {
+		return arg1 == nil && arg2 != nil, nil
+	}
+
+	// Addition - if either is a date, compare them as dates
+	t1, t2, isTime, err := toTimes(arg1, arg2)
+	if isTime {
 		if err != nil {
 			return false, err
 		}
-		foundT1 = true
+		return t2.After(t1), nil
 	}
-	if t, ok := arg2.(time.Time); ok {
-		t2 = t
-		foundT2 = true
-	} else if t, ok := arg2.(GetTime); ok {
-		t2, err = t.GetTime()
+
+	// And the same for decimals
+	d1, d2, isDecimal, err := toDecimals(arg1, arg2)
+	if isDecimal {
 		if err != nil {
 			return false, err
 		}
-		foundT2 = true
-	}
-
-	if foundT1 && foundT2 {
-		return t2.After(t1), nil
-	} else if foundT1 || foundT2 {
-		return false, errors.New("Cannot compare date with non-date")
+		return d1.Cmp(d2) < 0, nil
 	}
 
 	// Normal stuff
@@ -459,6 +456,7 @@ var funcMap = template.FuncMap{
 	"sub":       sub,
 	"mult":      mult,
 	"div":       div,
+	"round":     round,
 	"lt":        lt,
 	"gt":        gt,
 	"lte":       lte,
@@ -469,4 +467,69 @@ var funcMap = template.FuncMap{
 	"currency":  currency,
 	"substring": substring,
 	"date":      date,
+
+	"upper":        upper,
+	"lower":        lower,
+	"title":        title,
+	"trim":         trim,
+	"trimLeft":     trimLeft,
+	"trimRight":    trimRight,
+	"padLeft":      padLeft,
+	"padRight":     padRight,
+	"replace":      replace,
+	"regexReplace": regexReplace,
+	"regexMatch":   regexMatch,
+	"split":        split,
+	"join":         join,
+	"contains":     contains,
+	"hasPrefix":    hasPrefix,
+	"hasSuffix":    hasSuffix,
+	"length":       length,
+	"repeat":       repeat,
+
+	"now":          timeNow,
+	"parseDate":    parseDate,
+	"addDays":      addDays,
+	"addMonths":    addMonths,
+	"startOfMonth": startOfMonth,
+	"endOfMonth":   endOfMonth,
+	"age":          age,
+	"diffDays":     diffDays,
+	"inZone":       inZone,
+
+	"numberIn":       numberIn,
+	"currencyIn":     currencyIn,
+	"impliedDecimal": impliedDecimal,
+
+	"first":  first,
+	"last":   last,
+	"at":     at,
+	"count":  count,
+	"where":  where,
+	"filter": filter,
+	"pluck":  pluck,
+	"sum":    sum,
+	"sortBy": sortBy,
+	"uniq":   uniq,
+	// Bound to the tables by Expr.WithLookups
+	"lookup": Lookups(nil).lookup,
+
+	"empty":    empty,
+	"notEmpty": notEmpty,
+	"coalesce": coalesce,
+	"default":  withDefault,
+	"ifThen":   ifThen,
+	"all":      allTrue,
+	"any":      anyTrue,
+	"none":     noneTrue,
+
+	"mask":      mask,
+	"sha256":    sha256Hex,
+	"hmac":      hmacHex,
+	"base64enc": base64Encode,
+	"base64dec": base64Decode,
+	"hex":       hexEncode,
+	"uuid5":     uuid5,
+
+	escapeFunc: escaper(ESCAPE_NONE),
 }
@@ -0,0 +1,260 @@
+package data
+
+import (
+	"errors"
+	"strings"
+)
+
+// How a locale writes numbers and amounts of money
+type Locale struct {
+	// Separators between the whole and fractional parts, and between groups
+	// of thousands
+	Decimal string
+	Group   string
+	// Whether the currency symbol goes after the amount, and whether there's
+	// a space between them
+	SymbolAfter bool
+	SymbolSpace bool
+}
+
+// Locales that numberIn and currencyIn know, by BCP 47 tag. Add to it for
+// others.
+var Locales = map[string]Locale{
+	"en-US": {".", ",", false, false},
+	"en-CA": {".", ",", false, false},
+	"fr-CA": {",", " ", true, true},
+	"en-GB": {".", ",", false, false},
+	"en-IE": {".", ",", false, false},
+	"de-DE": {",", ".", true, true},
+	"de-AT": {",", " ", false, true},
+	"de-CH": {".", "'", false, true},
+	"fr-FR": {",", " ", true, true},
+	"fr-CH": {",", " ", true, true},
+	"es-ES": {",", ".", true, true},
+	"es-MX": {".", ",", false, false},
+	"it-IT": {",", ".", true, true},
+	"nl-NL": {",", ".", false, true},
+	"pt-BR": {",", ".", false, true},
+	"ja-JP": {".", ",", false, false},
+}
+
+// An ISO 4217 currency
+type Currency struct {
+	Symbol string
+	// Digits after the decimal point
+	Digits int
+}
+
+// Currencies that currencyIn knows, by ISO 4217 code. Add to it for others.
+var Currencies = map[string]Currency{
+	"USD": {"$", 2},
+	"CAD": {"$", 2},
+	"MXN": {"$", 2},
+	"AUD": {"$", 2},
+	"NZD": {"$", 2},
+	"EUR": {"€", 2},
+	"GBP": {"£", 2},
+	"CHF": {"CHF", 2},
+	"JPY": {"¥", 0},
+	"CNY": {"¥", 2},
+	"INR": {"₹", 2},
+	"BRL": {"R$", 2},
+	"SEK": {"kr", 2},
+	"NOK": {"kr", 2},
+	"DKK": {"kr", 2},
+	"BHD": {"BHD", 3},
+	"KWD": {"KWD", 3},
+}
+
+func findLocale(tag string) (Locale, error) {
+	if locale, ok := Locales[tag]; ok {
+		return locale, nil
+	}
+	normalized := strings.Replace(tag, "_", "-", -1)
+	for name, locale := range Locales {
+		if strings.EqualFold(name, normalized) {
+			return locale, nil
+		}
+	}
+	return Locale{}, errors.New("Unknown locale " + tag)
+}
+
+// Options for numberIn and currencyIn, given after the other arguments
+type formatOptions struct {
+	// Negative amounts in parentheses instead of after a minus sign
+	parens bool
+	// No separators between thousands
+	noGroup bool
+	// The ISO code instead of the symbol (currencyIn only)
+	code     bool
+	rounding int
+}
+
+func toFormatOptions(args []interface{}) (formatOptions, error) {
+	opts := formatOptions{rounding: DefaultRounding}
+	for _, arg := range args {
+		switch arg {
+		case "parens":
+			opts.parens = true
+		case "noGroup":
+			opts.noGroup = true
+		case "code":
+			opts.code = true
+		default:
+			mode, err := toRounding(arg)
+			if err != nil {
+				return opts, errors.New("Unknown option " + toString(arg))
+			}
+			opts.rounding = mode
+		}
+	}
+	return opts, nil
+}
+
+// Formats the absolute value in a locale. Returns whether it was negative.
+func formatIn(d Decimal, places int, locale Locale, opts formatOptions) (string, bool) {
+	fixed := d.StringFixed(places, opts.rounding)
+	negative := strings.HasPrefix(fixed, "-")
+	fixed = strings.TrimPrefix(fixed, "-")
+
+	whole, fraction := fixed, ""
+	if point := strings.IndexByte(fixed, '.'); point >= 0 {
+		whole, fraction = fixed[:point], fixed[point+1:]
+	}
+	if !opts.noGroup {
+		for i := len(whole) - 3; i > 0; i -= 3 {
+			whole = whole[:i] + locale.Group + whole[i:]
+		}
+	}
+	if len(fraction) > 0 {
+		whole += locale.Decimal + fraction
+	}
+	return whole, negative
+}
+
+func withSign(s string, negative bool, opts formatOptions) string {
+	if !negative {
+		return s
+	} else if opts.parens {
+		return "(" + s + ")"
+	}
+	return "-" + s
+}
+
+// Formats a number for a locale: numberIn amount places locale [options...]
+// where the options are "parens", "noGroup" and a rounding mode
+func numberIn(args ...interface{}) (string, error) {
+	if len(args) < 3 {
+		return "", errors.New("numberIn requires a number, the decimal places and a locale")
+	}
+	d, err := toDecimal(args[0])
+	if err != nil {
+		return "", err
+	}
+	places, err := toInt(args[1])
+	if err != nil {
+		return "", err
+	}
+	locale, err := findLocale(toString(args[2]))
+	if err != nil {
+		return "", err
+	}
+	opts, err := toFormatOptions(args[3:])
+	if err != nil {
+		return "", err
+	}
+
+	s, negative := formatIn(d, places, locale, opts)
+	return withSign(s, negative, opts), nil
+}
+
+// Formats an amount of money in an ISO 4217 currency for a locale:
+// currencyIn amount code [locale] [options...] where the locale defaults to
+// en-US and the options are "parens", "noGroup", "code" and a rounding mode
+func currencyIn(args ...interface{}) (string, error) {
+	if len(args) < 2 {
+		return "", errors.New("currencyIn requires an amount and a currency code")
+	}
+	d, err := toDecimal(args[0])
+	if err != nil {
+		return "", err
+	}
+	code := strings.ToUpper(toString(args[1]))
+	currency, ok := Currencies[code]
+	if !ok {
+		return "", errors.New("Unknown currency " + code)
+	}
+
+	tag := "en-US"
+	rest := args[2:]
+	if len(rest) > 0 {
+		if _, err := toFormatOptions(rest[:1]); err != nil {
+			tag = toString(rest[0])
+			rest = rest[1:]
+		}
+	}
+	locale, err := findLocale(tag)
+	if err != nil {
+		return "", err
+	}
+	opts, err := toFormatOptions(rest)
+	if err != nil {
+		return "", err
+	}
+
+	s, negative := formatIn(d, currency.Digits, locale, opts)
+
+	symbol := currency.Symbol
+	if opts.code {
+		symbol = code
+	}
+	space := ""
+	if locale.SymbolSpace || (opts.code && len(symbol) > 1) {
+		space = " "
+	}
+	if locale.SymbolAfter {
+		s = s + space + symbol
+	} else {
+		s = symbol + space + s
+	}
+	return withSign(s, negative, opts), nil
+}
+
+// Writes a number with an implied decimal point, as fixed-width formats
+// often want: impliedDecimal 123.45 2 9 is 000012345. The width (including
+// any minus sign) is optional.
+func impliedDecimal(args ...interface{}) (string, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return "", errors.New("impliedDecimal requires a number, the implied decimal places and optionally a width")
+	}
+	d, err := toDecimal(args[0])
+	if err != nil {
+		return "", err
+	}
+	places, err := toInt(args[1])
+	if err != nil {
+		return "", err
+	}
+
+	digits := strings.Replace(d.StringFixed(places, DefaultRounding), ".", "", 1)
+	negative := strings.HasPrefix(digits, "-")
+	digits = strings.TrimPrefix(digits, "-")
+
+	if len(args) == 3 {
+		width, err := toInt(args[2])
+		if err != nil {
+			return "", err
+		}
+		if negative {
+			width--
+		}
+		if len(digits) > width {
+			return "", errors.New("Number " + d.String() + " doesn't fit in the width")
+		}
+		digits = strings.Repeat("0", width-len(digits)) + digits
+	}
+	if negative {
+		digits = "-" + digits
+	}
+	return digits, nil
+}
@@ -0,0 +1,127 @@
+package data
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+// EMPTY VALUES AND LOGIC
+//
+// Sources are loosely typed, so nil, blank strings, zero times and empty
+// lists and maps are all empty. Anything empty is false, and so are false,
+// zero, and strings that say "false" or a number that is zero.
+
+func isEmpty(arg interface{}) bool {
+	switch v := arg.(type) {
+	case nil:
+		return true
+	case string:
+		return len(strings.TrimSpace(v)) == 0
+	case time.Time:
+		return v.IsZero()
+	case *time.Time:
+		return v == nil || v.IsZero()
+	}
+
+	value := reflect.ValueOf(arg)
+	switch value.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return value.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return value.IsNil()
+	}
+	return false
+}
+
+func truthy(arg interface{}) bool {
+	if isEmpty(arg) {
+		return false
+	}
+	switch v := arg.(type) {
+	case bool:
+		return v
+	case string:
+		v = strings.TrimSpace(v)
+		if strings.EqualFold(v, "false") {
+			return false
+		}
+		if d, err := ParseDecimal(v); err == nil {
+			return d.Sign() != 0
+		}
+		return true
+	}
+	if isNumber(arg) {
+		d, err := toDecimal(arg)
+		return err != nil || d.Sign() != 0
+	}
+	return true
+}
+
+func empty(arg interface{}) bool {
+	return isEmpty(arg)
+}
+
+func notEmpty(arg interface{}) bool {
+	return !isEmpty(arg)
+}
+
+// The first argument that isn't empty, e.g.
+// {{coalesce .workEmail .personalEmail "N/A"}}
+func coalesce(args ...interface{}) interface{} {
+	for _, arg := range args {
+		if !isEmpty(arg) {
+			return arg
+		}
+	}
+	return nil
+}
+
+// The value, or def if it's empty. The value comes last so it can be piped
+// in: {{.email | default "N/A"}}
+func withDefault(def interface{}, arg interface{}) interface{} {
+	if isEmpty(arg) {
+		return def
+	}
+	return arg
+}
+
+// then if the condition is true, otherwise the third argument (or nothing)
+func ifThen(cond interface{}, then interface{}, otherwise ...interface{}) interface{} {
+	if truthy(cond) {
+		return then
+	} else if len(otherwise) > 0 {
+		return otherwise[0]
+	}
+	return nil
+}
+
+// These are the template engine's and, or and not for loosely typed values,
+// which know that "false" and "0" are false. They're always true or false;
+// the engine's and and or still return one of their arguments, so
+// {{or .workEmail .personalEmail}} picks an email.
+
+// true if every argument is true
+func allTrue(arg interface{}, args ...interface{}) bool {
+	for _, next := range append([]interface{}{arg}, args...) {
+		if !truthy(next) {
+			return false
+		}
+	}
+	return true
+}
+
+// true if any argument is true
+func anyTrue(arg interface{}, args ...interface{}) bool {
+	for _, next := range append([]interface{}{arg}, args...) {
+		if truthy(next) {
+			return true
+		}
+	}
+	return false
+}
+
+// true if no argument is true
+func noneTrue(arg interface{}, args ...interface{}) bool {
+	return !anyTrue(arg, args...)
+}
@@ -0,0 +1,168 @@
+package data
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// PII FUNCTIONS
+//
+// Masking, hashing and encoding. A missing or empty value stays empty instead
+// of being hashed, so blanks don't all hash to the same thing.
+
+var (
+	ErrInvalidKeyName = errors.New("HMAC key names can't be empty")
+	ErrInvalidKey     = errors.New("HMAC keys can't be empty")
+)
+
+var (
+	hmacLock sync.RWMutex
+	hmacKeys = map[string][]byte{}
+)
+
+// RegisterHMACKey makes a secret key available to the hmac function by name,
+// so it never has to be written in EDL. Registering a name again replaces
+// its key.
+func RegisterHMACKey(name string, key []byte) error {
+	if len(name) == 0 {
+		return ErrInvalidKeyName
+	}
+	if len(key) == 0 {
+		return ErrInvalidKey
+	}
+	hmacLock.Lock()
+	defer hmacLock.Unlock()
+	hmacKeys[name] = append([]byte(nil), key...)
+	return nil
+}
+
+func toBytes(arg interface{}) []byte {
+	if b, ok := arg.([]byte); ok {
+		return b
+	}
+	return []byte(toString(arg))
+}
+
+// Replaces letters and digits with * (or the character given) except for
+// the last keep characters, so 123-45-6789 becomes ***-**-6789
+func mask(arg interface{}, keep interface{}, with ...string) (string, error) {
+	n, err := toInt(keep)
+	if err != nil {
+		return "", err
+	}
+	if n < 0 {
+		return "", errors.New("mask can't keep fewer than 0 characters, got " + toString(keep))
+	}
+	char := '*'
+	if len(with) > 0 {
+		runes := []rune(with[0])
+		if len(runes) != 1 {
+			return "", errors.New("mask requires a single character to mask with")
+		}
+		char = runes[0]
+	}
+
+	runes := []rune(toString(arg))
+	for i := 0; i < len(runes)-n; i++ {
+		if unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) {
+			runes[i] = char
+		}
+	}
+	return string(runes), nil
+}
+
+// Hex SHA-256
+func sha256Hex(arg interface{}) string {
+	b := toBytes(arg)
+	if len(b) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Hex HMAC-SHA256 with a key registered with RegisterHMACKey
+func hmacHex(arg interface{}, keyName string) (string, error) {
+	hmacLock.RLock()
+	key, ok := hmacKeys[keyName]
+	hmacLock.RUnlock()
+	if !ok {
+		return "", errors.New("Unknown HMAC key " + keyName)
+	}
+
+	b := toBytes(arg)
+	if len(b) == 0 {
+		return "", nil
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func base64Encode(arg interface{}) string {
+	return base64.StdEncoding.EncodeToString(toBytes(arg))
+}
+
+// Padding is optional
+func base64Decode(arg interface{}) (string, error) {
+	s := strings.TrimRight(strings.TrimSpace(toString(arg)), "=")
+	b, err := base64.RawStdEncoding.DecodeString(s)
+	if err != nil {
+		return "", errors.New("Invalid base64: " + err.Error())
+	}
+	return string(b), nil
+}
+
+func hexEncode(arg interface{}) string {
+	return hex.EncodeToString(toBytes(arg))
+}
+
+// Namespaces for uuid5 that RFC 4122 defines
+var uuidNamespaces = map[string]string{
+	"dns":  "6ba7b810-9dad-11d1-80b4-00c04fd430c8",
+	"url":  "6ba7b811-9dad-11d1-80b4-00c04fd430c8",
+	"oid":  "6ba7b812-9dad-11d1-80b4-00c04fd430c8",
+	"x500": "6ba7b814-9dad-11d1-80b4-00c04fd430c8",
+}
+
+func parseUUID(s string) ([]byte, error) {
+	if named, ok := uuidNamespaces[strings.ToLower(s)]; ok {
+		s = named
+	}
+	b, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil || len(b) != 16 {
+		return nil, errors.New("Invalid UUID " + s)
+	}
+	return b, nil
+}
+
+// A name-based (SHA-1) UUID, which is always the same for the same value in
+// the same namespace. The namespace is a UUID or one of "dns", "url", "oid"
+// and "x500".
+func uuid5(arg interface{}, namespace string) (string, error) {
+	ns, err := parseUUID(namespace)
+	if err != nil {
+		return "", err
+	}
+	b := toBytes(arg)
+	if len(b) == 0 {
+		return "", nil
+	}
+
+	h := sha1.New()
+	h.Write(ns)
+	h.Write(b)
+	u := h.Sum(nil)[:16]
+	u[6] = u[6]&0x0f | 0x50
+	u[8] = u[8]&0x3f | 0x80
+
+	s := hex.EncodeToString(u)
+	return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:], nil
+}
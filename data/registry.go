@@ -0,0 +1,216 @@
+package data
+
+import (
+	"errors"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+)
+
+var (
+	ErrInvalidFuncName = errors.New("Function names must be letters, digits and underscores, with at most one dot for a namespace")
+	ErrInvalidFunc     = errors.New("Functions must return one value, or a value and an error")
+	ErrBuiltinFunc     = errors.New("Built-in functions can't be replaced")
+	ErrFuncExists      = errors.New("A function with that name is already registered")
+)
+
+// A RegisterError is a function RegisterFunc refused
+type RegisterError struct {
+	Name string
+	Err  error
+}
+
+func (r *RegisterError) Error() string {
+	return "Can't register " + r.Name + ": " + r.Err.Error()
+}
+
+func (r *RegisterError) Unwrap() error {
+	return r.Err
+}
+
+// Namespaced functions (acme.planCode) are stored under a name the template
+// engine accepts (acme__planCode), and keys are rewritten to use it once
+// they're parsed
+const namespaceSeparator = "__"
+
+var funcNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// The template engine's own functions, which aren't in funcMap
+var engineFuncs = []string{"and", "call", "html", "index", "slice", "js", "len", "not", "or", "print", "printf", "println", "urlquery", "eq", "ge", "gt", "le", "lt", "ne"}
+
+var (
+	funcLock sync.RWMutex
+	// Functions registered with RegisterFunc
+	customFuncs = template.FuncMap{}
+	// Namespaces in use, each of which is also a function that fails (the
+	// template engine has to know the name when it parses the key)
+	namespaces = map[string]bool{}
+)
+
+// RegisterFunc makes fn available to EDL as name, for every key parsed from
+// then on. Names can be namespaced with a dot (e.g. "acme.planCode"), to
+// keep an application's functions from colliding with anybody else's. fn
+// must return a single value, or a value and an error, like any template
+// function. Built-in functions can't be replaced, and neither can functions
+// that are already registered.
+func RegisterFunc(name string, fn interface{}) error {
+	if !funcNamePattern.MatchString(name) || strings.Contains(name, namespaceSeparator) {
+		return &RegisterError{name, ErrInvalidFuncName}
+	}
+	fnType := reflect.TypeOf(fn)
+	if fnType == nil || fnType.Kind() != reflect.Func || !validReturns(fnType) {
+		return &RegisterError{name, ErrInvalidFunc}
+	}
+
+	funcLock.Lock()
+	defer funcLock.Unlock()
+
+	namespace := ""
+	if dot := strings.Index(name, "."); dot >= 0 {
+		namespace = name[:dot]
+		name = namespace + namespaceSeparator + name[dot+1:]
+	}
+
+	for _, taken := range []string{name, namespace} {
+		if len(taken) == 0 {
+			continue
+		}
+		if isBuiltin(taken) {
+			return &RegisterError{taken, ErrBuiltinFunc}
+		}
+	}
+	if _, ok := customFuncs[name]; ok || namespaces[name] {
+		return &RegisterError{displayName(name), ErrFuncExists}
+	}
+	if _, ok := customFuncs[namespace]; ok && !namespaces[namespace] {
+		return &RegisterError{namespace, ErrFuncExists}
+	}
+
+	customFuncs[name] = fn
+	if len(namespace) > 0 && !namespaces[namespace] {
+		namespaces[namespace] = true
+		customFuncs[namespace] = func(...interface{}) (string, error) {
+			return "", errors.New(namespace + " is a namespace, not a function")
+		}
+	}
+	return nil
+}
+
+func validReturns(fnType reflect.Type) bool {
+	switch fnType.NumOut() {
+	case 1:
+		return true
+	case 2:
+		return fnType.Out(1) == reflect.TypeOf((*error)(nil)).Elem()
+	}
+	return false
+}
+
+func isBuiltin(name string) bool {
+	if _, ok := funcMap[name]; ok {
+		return true
+	}
+	for _, engineFunc := range engineFuncs {
+		if name == engineFunc {
+			return true
+		}
+	}
+	return false
+}
+
+// acme__planCode is acme.planCode to whoever wrote the key
+func displayName(name string) string {
+	return strings.Replace(name, namespaceSeparator, ".", 1)
+}
+
+// Looks up a function by the name it's stored under
+func lookupFunc(name string) (interface{}, bool) {
+	if fn, ok := funcMap[name]; ok {
+		return fn, true
+	}
+	funcLock.RLock()
+	defer funcLock.RUnlock()
+	fn, ok := customFuncs[name]
+	return fn, ok
+}
+
+// Parses a key with the built-in and registered functions, and points calls
+// to namespaced functions at the names they're stored under
+func parseKey(key string) (*template.Template, error) {
+	funcLock.RLock()
+	tmpl := template.New("tmpl").Funcs(funcMap).Funcs(customFuncs)
+	funcLock.RUnlock()
+
+	tmpl, err := tmpl.Parse(key)
+	if err != nil {
+		return nil, err
+	}
+	resolveNamespaces(tmpl.Tree.Root)
+	return tmpl, nil
+}
+
+// The template engine reads acme.planCode as the function acme, followed by
+// the field planCode of whatever it returns
+func resolveNamespaces(node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			resolveNamespaces(child)
+		}
+	case *parse.ActionNode:
+		resolveNamespaces(n.Pipe)
+	case *parse.IfNode:
+		resolveNamespaces(n.Pipe)
+		resolveNamespaces(n.List)
+		resolveNamespaces(n.ElseList)
+	case *parse.RangeNode:
+		resolveNamespaces(n.Pipe)
+		resolveNamespaces(n.List)
+		resolveNamespaces(n.ElseList)
+	case *parse.WithNode:
+		resolveNamespaces(n.Pipe)
+		resolveNamespaces(n.List)
+		resolveNamespaces(n.ElseList)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			for i, arg := range cmd.Args {
+				if name, ok := namespacedFunc(arg); ok {
+					cmd.Args[i] = parse.NewIdentifier(name).SetPos(arg.Position())
+				} else {
+					resolveNamespaces(arg)
+				}
+			}
+		}
+	case *parse.ChainNode:
+		resolveNamespaces(n.Node)
+	}
+}
+
+// Whether node is a call to a namespaced function, and if so the name it's
+// stored under
+func namespacedFunc(node parse.Node) (string, bool) {
+	chain, ok := node.(*parse.ChainNode)
+	if !ok || len(chain.Field) != 1 {
+		return "", false
+	}
+	ident, ok := chain.Node.(*parse.IdentifierNode)
+	if !ok {
+		return "", false
+	}
+
+	funcLock.RLock()
+	defer funcLock.RUnlock()
+	if !namespaces[ident.Ident] {
+		return "", false
+	}
+	return ident.Ident + namespaceSeparator + chain.Field[0], true
+}
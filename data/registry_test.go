@@ -0,0 +1,71 @@
+package data
+
+import (
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+)
+
+func TestRegisterFunc(t *testing.T) {
+	Convey("RegisterFunc", t, func() {
+		datum := &Datum{}
+		datum.SetSource(dm, "")
+
+		Convey("Adds a function", func() {
+			err := RegisterFunc("shout", func(s string) string {
+				return strings.ToUpper(s) + "!"
+			})
+			So(err, ShouldEqual, nil)
+			So(datum.Get("{{shout .e}}", ""), ShouldEqual, "BAR!")
+			So(datum.Get("{{.f.g | shout}}", ""), ShouldEqual, "BOOP!")
+		})
+
+		Convey("Adds a namespaced function", func() {
+			err := RegisterFunc("acme.planCode", func(s string) (string, error) {
+				if s == "bar" {
+					return "PPO-1", nil
+				}
+				return "", errors.New("unknown plan " + s)
+			})
+			So(err, ShouldEqual, nil)
+			So(RegisterFunc("acme.carrier", func() string { return "ACME" }), ShouldEqual, nil)
+
+			So(datum.Get("{{acme.planCode .e}} {{acme.carrier}}", ""), ShouldEqual, "PPO-1 ACME")
+			So(datum.Get("{{if (eq (acme.planCode .e) \"PPO-1\")}}yes{{end}}", ""), ShouldEqual, "yes")
+
+			_, err = datum.GetE("{{acme.planCode .f.g}}", "")
+			So(err.(*EvalError).Func, ShouldEqual, "acme__planCode")
+
+			So(Validate("{{acme.planCode}}")[0].Message, ShouldEqual, "acme.planCode takes 1 argument, not 0")
+		})
+
+		Convey("Refuses to replace built-ins", func() {
+			err := RegisterFunc("currency", func(s string) string { return s })
+			So(errors.Is(err, ErrBuiltinFunc), ShouldEqual, true)
+			So(errors.Is(RegisterFunc("printf", func() string { return "" }), ErrBuiltinFunc), ShouldEqual, true)
+			So(errors.Is(RegisterFunc("date.format", func() string { return "" }), ErrBuiltinFunc), ShouldEqual, true)
+			So(datum.Get("{{currency 5}}", ""), ShouldEqual, "$5.00")
+		})
+
+		Convey("Refuses collisions", func() {
+			So(RegisterFunc("once", func() string { return "1" }), ShouldEqual, nil)
+			err := RegisterFunc("once", func() string { return "2" })
+			So(errors.Is(err, ErrFuncExists), ShouldEqual, true)
+			So(err.Error(), ShouldEqual, "Can't register once: "+ErrFuncExists.Error())
+
+			So(RegisterFunc("beta.one", func() string { return "1" }), ShouldEqual, nil)
+			So(errors.Is(RegisterFunc("beta", func() string { return "" }), ErrFuncExists), ShouldEqual, true)
+			So(errors.Is(RegisterFunc("once.more", func() string { return "" }), ErrFuncExists), ShouldEqual, true)
+		})
+
+		Convey("Checks names and functions", func() {
+			So(errors.Is(RegisterFunc("a.b.c", func() string { return "" }), ErrInvalidFuncName), ShouldEqual, true)
+			So(errors.Is(RegisterFunc("a__b", func() string { return "" }), ErrInvalidFuncName), ShouldEqual, true)
+			So(errors.Is(RegisterFunc("9lives", func() string { return "" }), ErrInvalidFuncName), ShouldEqual, true)
+			So(errors.Is(RegisterFunc("notFunc", "nope"), ErrInvalidFunc), ShouldEqual, true)
+			So(errors.Is(RegisterFunc("noResult", func() {}), ErrInvalidFunc), ShouldEqual, true)
+			So(errors.Is(RegisterFunc("twoResults", func() (string, string) { return "", "" }), ErrInvalidFunc), ShouldEqual, true)
+		})
+	})
+}
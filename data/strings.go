@@ -0,0 +1,238 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// STRING FUNCTIONS
+//
+// These take the string first, like substring. Anything that isn't a string
+// is formatted as one, and a missing value is an empty string.
+
+func toString(arg interface{}) string {
+	if arg == nil {
+		return ""
+	}
+	if s, ok := arg.(string); ok {
+		return s
+	}
+	return fmt.Sprint(arg)
+}
+
+// Whole numbers, and anything else toDecimal takes with the fraction
+// dropped
+func toInt(arg interface{}) (int, error) {
+	d, err := toDecimal(arg)
+	if err != nil {
+		return 0, errors.New("Expected a number, got " + toString(arg))
+	}
+	i := d.Round(0, ROUND_TRUNCATE).int()
+	if !i.IsInt64() || int64(int(i.Int64())) != i.Int64() {
+		return 0, errors.New("Number " + d.String() + " is too big")
+	}
+	return int(i.Int64()), nil
+}
+
+func upper(arg interface{}) string {
+	return strings.ToUpper(toString(arg))
+}
+
+func lower(arg interface{}) string {
+	return strings.ToLower(toString(arg))
+}
+
+// Capitalizes the first letter of every word and lowercases the rest, so
+// "JOHN o'BRIEN" becomes "John O'brien"
+func title(arg interface{}) string {
+	runes := []rune(toString(arg))
+	start := true
+	for i, r := range runes {
+		if unicode.IsSpace(r) || r == '-' {
+			start = true
+			continue
+		}
+		if start {
+			runes[i] = unicode.ToUpper(r)
+		} else {
+			runes[i] = unicode.ToLower(r)
+		}
+		start = false
+	}
+	return string(runes)
+}
+
+// Trims whitespace, or the characters in the second argument if there is one
+func trim(args ...interface{}) (string, error) {
+	return trimWith(strings.TrimSpace, strings.Trim, args)
+}
+
+func trimLeft(args ...interface{}) (string, error) {
+	return trimWith(func(s string) string {
+		return strings.TrimLeftFunc(s, unicode.IsSpace)
+	}, strings.TrimLeft, args)
+}
+
+func trimRight(args ...interface{}) (string, error) {
+	return trimWith(func(s string) string {
+		return strings.TrimRightFunc(s, unicode.IsSpace)
+	}, strings.TrimRight, args)
+}
+
+func trimWith(space func(string) string, cutset func(string, string) string, args []interface{}) (string, error) {
+	switch len(args) {
+	case 1:
+		return space(toString(args[0])), nil
+	case 2:
+		return cutset(toString(args[0]), toString(args[1])), nil
+	}
+	return "", errors.New("trim requires a string and optionally the characters to trim")
+}
+
+// Pads to a width with spaces, or with the character in the third argument
+// if there is one. Longer strings are left alone.
+func padLeft(args ...interface{}) (string, error) {
+	s, padding, err := pad(args)
+	return padding + s, err
+}
+
+func padRight(args ...interface{}) (string, error) {
+	s, padding, err := pad(args)
+	return s + padding, err
+}
+
+func pad(args []interface{}) (string, string, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return "", "", errors.New("pad requires a string, a width and optionally a fill character")
+	}
+	s := toString(args[0])
+	width, err := toInt(args[1])
+	if err != nil {
+		return "", "", err
+	}
+	fill := " "
+	if len(args) == 3 {
+		fill = toString(args[2])
+		if utf8.RuneCountInString(fill) != 1 {
+			return "", "", errors.New("pad fill must be a single character, got " + fill)
+		}
+	}
+
+	missing := width - utf8.RuneCountInString(s)
+	if missing <= 0 {
+		return s, "", nil
+	}
+	return s, strings.Repeat(fill, missing), nil
+}
+
+func replace(arg interface{}, old string, new string) string {
+	return strings.Replace(toString(arg), old, new, -1)
+}
+
+var (
+	regexLock  sync.Mutex
+	regexCache = map[string]*regexp.Regexp{}
+)
+
+// Compiled patterns are kept, since the same ones come up for every row
+func compileRegex(pattern string) (*regexp.Regexp, error) {
+	regexLock.Lock()
+	defer regexLock.Unlock()
+	if re, ok := regexCache[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	regexCache[pattern] = re
+	return re, nil
+}
+
+// Replaces matches of a regular expression. The replacement can refer to
+// groups, e.g. "$1".
+func regexReplace(arg interface{}, pattern string, repl string) (string, error) {
+	re, err := compileRegex(pattern)
+	if err != nil {
+		return "", err
+	}
+	return re.ReplaceAllString(toString(arg), repl), nil
+}
+
+func regexMatch(arg interface{}, pattern string) (bool, error) {
+	re, err := compileRegex(pattern)
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(toString(arg)), nil
+}
+
+func split(arg interface{}, sep string) []string {
+	s := toString(arg)
+	if len(s) == 0 {
+		return []string{}
+	}
+	return strings.Split(s, sep)
+}
+
+// Joins any kind of list
+func join(list interface{}, sep string) (string, error) {
+	if list == nil {
+		return "", nil
+	}
+	if strs, ok := list.([]string); ok {
+		return strings.Join(strs, sep), nil
+	}
+
+	value := reflect.ValueOf(list)
+	if value.Kind() != reflect.Slice && value.Kind() != reflect.Array {
+		return "", errors.New("join requires a list")
+	}
+	strs := make([]string, value.Len())
+	for i := range strs {
+		strs[i] = toString(value.Index(i).Interface())
+	}
+	return strings.Join(strs, sep), nil
+}
+
+func contains(arg interface{}, substr string) bool {
+	return strings.Contains(toString(arg), substr)
+}
+
+func hasPrefix(arg interface{}, prefix string) bool {
+	return strings.HasPrefix(toString(arg), prefix)
+}
+
+func hasSuffix(arg interface{}, suffix string) bool {
+	return strings.HasSuffix(toString(arg), suffix)
+}
+
+// The number of characters in a string, or items in a list or map
+func length(arg interface{}) int {
+	if arg == nil {
+		return 0
+	}
+	value := reflect.ValueOf(arg)
+	switch value.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return value.Len()
+	}
+	return utf8.RuneCountInString(toString(arg))
+}
+
+func repeat(arg interface{}, count interface{}) (string, error) {
+	n, err := toInt(count)
+	if err != nil {
+		return "", err
+	}
+	if n < 0 {
+		return "", errors.New("repeat count can't be negative")
+	}
+	return strings.Repeat(toString(arg), n), nil
+}
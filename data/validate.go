@@ -0,0 +1,316 @@
+package data
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template/parse"
+)
+
+// A Diagnostic is a problem Validate found in a key
+type Diagnostic struct {
+	// Where the problem is, counting from 1. Col is 0 if it isn't known.
+	Line int
+	Col  int
+	// The function or field the problem is with, if any
+	Func  string
+	Field string
+
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	pos := strconv.Itoa(d.Line)
+	if d.Col > 0 {
+		pos += ":" + strconv.Itoa(d.Col)
+	}
+	return pos + ": " + d.Message
+}
+
+// A Schema says which fields a source has, for Validate
+type Schema interface {
+	// path is the field's name split on dots, e.g. []string{"f", "g"} for .f.g
+	HasField(path []string) bool
+}
+
+type fieldSchema map[string]bool
+
+func (f fieldSchema) HasField(path []string) bool {
+	return f[strings.Join(path, ".")]
+}
+
+// Fields is a schema that has the given fields, written with dots (e.g.
+// "address.city"). The parents of a field (e.g. "address") are fields too.
+func Fields(paths ...string) Schema {
+	schema := fieldSchema{}
+	for _, path := range paths {
+		parts := strings.Split(strings.TrimPrefix(path, "."), ".")
+		for i := range parts {
+			schema[strings.Join(parts[:i+1], ".")] = true
+		}
+	}
+	return schema
+}
+
+type sampleSchema struct {
+	source interface{}
+}
+
+// Sample is a schema that has the fields of a sample source (a map or struct,
+// as for Datum.SetSource)
+func Sample(src interface{}, tagName string) (Schema, error) {
+	datum := &Datum{}
+	err := datum.SetSourceE(src, tagName)
+	if err != nil {
+		return nil, err
+	}
+	return &sampleSchema{datum.Source}, nil
+}
+
+func (s *sampleSchema) HasField(path []string) bool {
+	value := reflect.ValueOf(s.source)
+	for _, name := range path {
+		for value.Kind() == reflect.Interface || value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				// Nothing to go on
+				return true
+			}
+			value = value.Elem()
+		}
+
+		switch {
+		case value.Kind() == reflect.Map && value.Type().Key().Kind() == reflect.String:
+			value = value.MapIndex(reflect.ValueOf(name).Convert(value.Type().Key()))
+			if !value.IsValid() {
+				return false
+			}
+		case value.Kind() == reflect.Struct && value.FieldByName(name).IsValid():
+			value = value.FieldByName(name)
+		default:
+			// Methods, e.g. .Year on a time. What they return isn't known.
+			return value.IsValid() && (value.MethodByName(name).IsValid() ||
+				(value.CanAddr() && value.Addr().MethodByName(name).IsValid()))
+		}
+	}
+	return true
+}
+
+// The number of arguments a function takes, for those whose signature
+// doesn't say (max is -1 for no limit). These must match the functions' own
+// checks, which TestFuncArity keeps honest.
+type arity struct {
+	min, max int
+}
+
+var funcArity = map[string]arity{
+	"add":            {1, -1},
+	"sub":            {1, -1},
+	"mult":           {1, -1},
+	"div":            {1, -1},
+	"currency":       {1, 2},
+	"substring":      {2, 2},
+	"date":           {1, 2},
+	"number":         {1, 3},
+	"round":          {1, 3},
+	"numberIn":       {3, -1},
+	"currencyIn":     {2, -1},
+	"impliedDecimal": {2, 3},
+	"eq":             {2, -1},
+	"trim":           {1, 2},
+	"trimLeft":       {1, 2},
+	"trimRight":      {1, 2},
+	"padLeft":        {2, 3},
+	"padRight":       {2, 3},
+	"parseDate":      {1, 2},
+	"age":            {1, 2},
+	"at":             {1, -1},
+	"count":          {1, 3},
+	"sum":            {1, 2},
+	"sortBy":         {2, 3},
+	"lookup":         {2, 3},
+	"ifThen":         {2, 3},
+	"mask":           {2, 3},
+}
+
+// Functions that take only some of the numbers of arguments between their
+// min and max
+var funcArgCounts = map[string][]int{
+	"count": {1, 3},
+}
+
+func takes(counts []int, given int) bool {
+	for _, n := range counts {
+		if n == given {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate parses a key and checks that every function exists and is given
+// the right number of arguments. If any schemas are given, it also checks
+// that every field the key uses is in at least one of them. Fields inside
+// range and with blocks aren't checked, because they're relative to
+// something else. Returns nothing if the key is fine.
+func Validate(key string, schemas ...Schema) []Diagnostic {
+	tmpl, err := parseKey(key)
+	if err != nil {
+		evalErr := newEvalError(key, err)
+		return []Diagnostic{{
+			Line:    evalErr.Line,
+			Col:     evalErr.Col,
+			Func:    evalErr.Func,
+			Message: evalErr.Message,
+		}}
+	}
+
+	v := &validator{key: key, schemas: schemas}
+	v.node(tmpl.Tree.Root, true)
+	return v.diagnostics
+}
+
+type validator struct {
+	key         string
+	schemas     []Schema
+	diagnostics []Diagnostic
+}
+
+func (v *validator) report(pos parse.Pos, d Diagnostic) {
+	before := v.key[:pos]
+	d.Line = 1 + strings.Count(before, "\n")
+	d.Col = len(before) - strings.LastIndex(before, "\n")
+	v.diagnostics = append(v.diagnostics, d)
+}
+
+// root is whether dot is still the source
+func (v *validator) node(node parse.Node, root bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			v.node(child, root)
+		}
+	case *parse.ActionNode:
+		v.pipe(n.Pipe, root)
+	case *parse.IfNode:
+		v.pipe(n.Pipe, root)
+		v.node(n.List, root)
+		v.node(n.ElseList, root)
+	case *parse.RangeNode:
+		v.pipe(n.Pipe, root)
+		v.node(n.List, false)
+		v.node(n.ElseList, root)
+	case *parse.WithNode:
+		v.pipe(n.Pipe, root)
+		v.node(n.List, false)
+		v.node(n.ElseList, root)
+	}
+}
+
+func (v *validator) pipe(pipe *parse.PipeNode, root bool) {
+	if pipe == nil {
+		return
+	}
+	for i, cmd := range pipe.Cmds {
+		args := cmd.Args
+		if ident, ok := args[0].(*parse.IdentifierNode); ok {
+			given := len(args) - 1
+			if i > 0 {
+				// The result of the previous command is passed as the last
+				// argument
+				given++
+			}
+			v.function(ident, given)
+			args = args[1:]
+		}
+		for _, arg := range args {
+			v.arg(arg, root)
+		}
+	}
+}
+
+func (v *validator) arg(node parse.Node, root bool) {
+	switch n := node.(type) {
+	case *parse.FieldNode:
+		if root {
+			// The position is of the last part, e.g. .g in .f.g
+			pos := n.Position()
+			for _, part := range n.Ident[:len(n.Ident)-1] {
+				pos -= parse.Pos(len(part) + 1)
+			}
+			v.field(pos, n.Ident)
+		}
+	case *parse.VariableNode:
+		// $ is always the source
+		if n.Ident[0] == "$" && len(n.Ident) > 1 {
+			v.field(n.Position(), n.Ident[1:])
+		}
+	case *parse.PipeNode:
+		v.pipe(n, root)
+	case *parse.ChainNode:
+		v.arg(n.Node, root)
+	}
+}
+
+func (v *validator) field(pos parse.Pos, path []string) {
+	if len(v.schemas) == 0 {
+		return
+	}
+	for _, schema := range v.schemas {
+		if schema.HasField(path) {
+			return
+		}
+	}
+	name := strings.Join(path, ".")
+	v.report(pos, Diagnostic{Field: name, Message: "Unknown field ." + name})
+}
+
+func (v *validator) function(ident *parse.IdentifierNode, given int) {
+	fn, ok := lookupFunc(ident.Ident)
+	if !ok {
+		// One of the template engine's own
+		return
+	}
+
+	expected, ok := funcArity[ident.Ident]
+	if !ok {
+		fnType := reflect.TypeOf(fn)
+		expected = arity{fnType.NumIn(), fnType.NumIn()}
+		if fnType.IsVariadic() {
+			expected = arity{fnType.NumIn() - 1, -1}
+		}
+	}
+
+	var msg string
+	if only, ok := funcArgCounts[ident.Ident]; ok && !takes(only, given) {
+		counts := make([]string, len(only))
+		for i, n := range only {
+			counts[i] = strconv.Itoa(n)
+		}
+		msg = strings.Join(counts, " or ")
+	} else if given < expected.min {
+		msg = "at least " + strconv.Itoa(expected.min)
+		if expected.min == expected.max {
+			msg = strconv.Itoa(expected.min)
+		}
+	} else if expected.max >= 0 && given > expected.max {
+		msg = "at most " + strconv.Itoa(expected.max)
+		if expected.min == expected.max {
+			msg = strconv.Itoa(expected.max)
+		}
+	} else {
+		return
+	}
+
+	noun := " arguments"
+	if msg == "1" || strings.HasSuffix(msg, " 1") {
+		noun = " argument"
+	}
+	name := displayName(ident.Ident)
+	v.report(ident.Position(), Diagnostic{
+		Func:    name,
+		Message: name + " takes " + msg + noun + ", not " + strconv.Itoa(given),
+	})
+}
@@ -0,0 +1,119 @@
+package data
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	Convey("Validate", t, func() {
+		Convey("Accepts good keys", func() {
+			for _, assertion := range assertions {
+				So(Validate(assertion.key), ShouldBeEmpty)
+			}
+		})
+
+		Convey("Reports parse errors", func() {
+			diagnostics := Validate("{{.a}}\n{{if .b}}")
+			So(len(diagnostics), ShouldEqual, 1)
+			So(diagnostics[0].Line, ShouldEqual, 2)
+		})
+
+		Convey("Reports unknown functions", func() {
+			diagnostics := Validate("{{curency .a}}")
+			So(len(diagnostics), ShouldEqual, 1)
+			So(diagnostics[0].Func, ShouldEqual, "curency")
+		})
+
+		Convey("Checks the number of arguments", func() {
+			diagnostics := Validate("{{substring .e}} {{.a | currency 2 3}}\n  {{gt .a}} {{neq .a 1 2}}")
+			So(len(diagnostics), ShouldEqual, 4)
+			So(diagnostics[0].String(), ShouldEqual, "1:3: substring takes 2 arguments, not 1")
+			So(diagnostics[1].String(), ShouldEqual, "1:25: currency takes at most 2 arguments, not 3")
+			So(diagnostics[2].String(), ShouldEqual, "2:5: gt takes 2 arguments, not 1")
+			So(diagnostics[3].String(), ShouldEqual, "2:15: neq takes 2 arguments, not 3")
+
+			diagnostics = Validate(`{{count .y "age"}} {{count .y "age" 9}}`)
+			So(len(diagnostics), ShouldEqual, 1)
+			So(diagnostics[0].Message, ShouldEqual, "count takes 1 or 3 arguments, not 2")
+		})
+
+		Convey("Checks fields against a list", func() {
+			diagnostics := Validate("{{.a}} {{.f.g}} {{.f.x}} {{if .zz}}{{end}}", Fields("a", "f.g"))
+			So(len(diagnostics), ShouldEqual, 2)
+			So(diagnostics[0].Field, ShouldEqual, "f.x")
+			So(diagnostics[0].Col, ShouldEqual, 19)
+			So(diagnostics[1].Field, ShouldEqual, "zz")
+		})
+
+		Convey("Checks fields against a sample", func() {
+			schema, err := Sample(dm, "")
+			So(err, ShouldEqual, nil)
+			So(Validate("{{add .a .b.c}} {{.h.Year}} {{$.f.g}}", schema), ShouldBeEmpty)
+
+			diagnostics := Validate("{{.b.x}} {{.e.x}} {{$.nope}}", schema)
+			So(len(diagnostics), ShouldEqual, 3)
+			So(diagnostics[2].Message, ShouldEqual, "Unknown field .nope")
+		})
+
+		Convey("Doesn't check fields relative to something else", func() {
+			schema := Fields("b")
+			So(Validate("{{range .b}}{{.whatever}}{{end}}{{with .b}}{{.c}}{{end}}", schema), ShouldBeEmpty)
+		})
+
+		Convey("Uses any of the schemas", func() {
+			So(Validate("{{.a}} {{.b}}", Fields("a"), Fields("b")), ShouldBeEmpty)
+		})
+
+		Convey("Rejects samples that aren't maps or structs", func() {
+			_, err := Sample("nope", "")
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
+
+func TestFuncArity(t *testing.T) {
+	Convey("Function arities", t, func() {
+		Convey("Match the functions' signatures", func() {
+			for name, expected := range funcArity {
+				fn, ok := funcMap[name]
+				So(ok, ShouldBeTrue)
+
+				fnType := reflect.TypeOf(fn)
+				fixed := fnType.NumIn()
+				if fnType.IsVariadic() {
+					fixed--
+				} else {
+					So(expected.max, ShouldEqual, fixed)
+				}
+				So(expected.min, ShouldBeGreaterThanOrEqualTo, fixed)
+				So(expected.max == -1 || expected.max >= expected.min, ShouldBeTrue)
+			}
+
+			for name, counts := range funcArgCounts {
+				expected, ok := funcArity[name]
+				So(ok, ShouldBeTrue)
+				for _, n := range counts {
+					So(n >= expected.min && (expected.max == -1 || n <= expected.max), ShouldBeTrue)
+				}
+			}
+		})
+
+		Convey("Are given for every variadic function that has a limit", func() {
+			// These take any number of arguments after the fixed ones, as
+			// their signatures say
+			unlimited := []string{"_escape", "all", "any", "coalesce", "none"}
+
+			var missing []string
+			for name, fn := range funcMap {
+				if _, ok := funcArity[name]; !ok && reflect.TypeOf(fn).IsVariadic() {
+					missing = append(missing, name)
+				}
+			}
+			sort.Strings(missing)
+			So(missing, ShouldResemble, unlimited)
+		})
+	})
+}
@@ -0,0 +1,217 @@
+package data
+
+import (
+	"errors"
+	"io/ioutil"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// The kinds of Value
+const (
+	VALUE_NULL = iota
+	VALUE_STRING
+	// Any of go's integer and float types
+	VALUE_NUMBER
+	VALUE_DECIMAL
+	VALUE_BOOL
+	VALUE_TIME
+)
+
+// A Value is what a key evaluates to, before it's printed. Keys that are a
+// single action (e.g. {{.salary}} or {{add .a .b}}) evaluate to whatever the
+// action does; any other key is a string.
+type Value struct {
+	Kind int
+	raw  interface{}
+	text string
+}
+
+// NewValue returns the value of v, which is of whichever kind v is. Values
+// that aren't of any of the kinds (e.g. maps) are strings.
+func NewValue(v interface{}) Value {
+	return newValue(v, ESCAPE_NONE)
+}
+
+// The string is v printed with the given escaping, as Get would
+func newValue(v interface{}, mode int) Value {
+	v = indirect(v)
+	text := escapeResult(escaper(mode)(v), mode)
+	switch t := v.(type) {
+	case nil:
+		return Value{VALUE_NULL, nil, ""}
+	case string:
+		return Value{VALUE_STRING, t, text}
+	case bool:
+		return Value{VALUE_BOOL, t, text}
+	case time.Time:
+		return Value{VALUE_TIME, t, text}
+	case *time.Time:
+		if t == nil {
+			return Value{VALUE_NULL, nil, ""}
+		}
+		return Value{VALUE_TIME, *t, text}
+	case Decimal:
+		return Value{VALUE_DECIMAL, t, text}
+	case *Decimal:
+		if t == nil {
+			return Value{VALUE_NULL, nil, ""}
+		}
+		return Value{VALUE_DECIMAL, *t, text}
+	case GetTime:
+		if tm, err := t.GetTime(); err == nil {
+			return Value{VALUE_TIME, tm, text}
+		}
+	}
+	if isNumber(v) {
+		return Value{VALUE_NUMBER, v, text}
+	}
+	return Value{VALUE_STRING, text, text}
+}
+
+// String returns the value as Get would
+func (v Value) String() string {
+	return v.text
+}
+
+// Interface returns the value as nil, a string, a go number, a Decimal, a
+// bool or a time.Time, depending on its kind
+func (v Value) Interface() interface{} {
+	return v.raw
+}
+
+func (v Value) IsNull() bool {
+	return v.Kind == VALUE_NULL
+}
+
+// Decimal returns numbers, decimals and strings that are numbers as
+// decimals. Anything else is an error.
+func (v Value) Decimal() (Decimal, error) {
+	switch v.Kind {
+	case VALUE_NUMBER, VALUE_DECIMAL, VALUE_STRING:
+		return toDecimal(v.raw)
+	}
+	return Decimal{}, errors.New("Not a number: " + v.text)
+}
+
+// Time returns times, and strings in any of the TimeFormats, as times.
+// Anything else is an error.
+func (v Value) Time() (time.Time, error) {
+	switch v.Kind {
+	case VALUE_TIME, VALUE_STRING:
+		return toTime(v.raw)
+	}
+	return time.Time{}, errors.New("Not a date: " + v.text)
+}
+
+// Bool is whether the value is true, the same way and, or and not decide
+func (v Value) Bool() bool {
+	return truthy(v.raw)
+}
+
+// A ValueGetter is a Getter that can return typed values
+type ValueGetter interface {
+	Getter
+	GetValue(key string, defaultValue string) (Value, error)
+}
+
+// A ValueEvaluator is an Evaluator that can return typed values
+type ValueEvaluator interface {
+	Evaluator
+	EvalValue(expr *Expr, defaultValue *Expr) (Value, error)
+}
+
+// The function that the action of a single-action key hands its value to
+const captureFunc = "_capture"
+
+// For keys that are a single action, a copy of the parse tree that hands
+// the action's value to captureFunc instead of printing it. Nil for any
+// other key.
+func captureTree(tree *parse.Tree) *parse.Tree {
+	if len(tree.Root.Nodes) != 1 {
+		return nil
+	}
+	action, ok := tree.Root.Nodes[0].(*parse.ActionNode)
+	if !ok || len(action.Pipe.Decl) > 0 {
+		return nil
+	}
+
+	captured := tree.Copy()
+	action = captured.Root.Nodes[0].(*parse.ActionNode)
+	action.Pipe.Cmds = append(action.Pipe.Cmds, &parse.CommandNode{
+		NodeType: parse.NodeCommand,
+		Pos:      action.Pos,
+		Args:     []parse.Node{parse.NewIdentifier(captureFunc).SetPos(action.Pos)},
+	})
+	return captured
+}
+
+// A template that captures a value. Each one can only be used by one
+// goroutine at a time, so they're pooled.
+type capture struct {
+	tmpl  *template.Template
+	value interface{}
+}
+
+func (c *capture) set(args ...interface{}) string {
+	if len(args) > 0 {
+		c.value = args[len(args)-1]
+	}
+	return ""
+}
+
+// Pools of captures, for normal and strict runs
+type capturePools [2]sync.Pool
+
+func (c *compiled) newCapture(strict bool, lookups *boundLookups) *capture {
+	captured := &capture{}
+	captured.tmpl, _ = c.tmpl.Clone()
+	captured.tmpl.AddParseTree(captured.tmpl.Name(), c.captured)
+
+	funcs := template.FuncMap{captureFunc: captured.set}
+	if lookups != nil {
+		funcs["lookup"] = lookups.lookups.lookup
+	}
+	captured.tmpl.Funcs(funcs)
+	if strict {
+		captured.tmpl.Option("missingkey=error")
+	}
+	return captured
+}
+
+// Evaluates to a typed value, or to a string if the key isn't a single
+// action
+func (e *Expr) value(src interface{}, mode int, strict bool) (Value, error) {
+	mode = e.escapeMode(mode)
+	if e.captured == nil {
+		text, err := e.execute(src, mode, strict)
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{VALUE_STRING, text, text}, nil
+	}
+
+	pools := &e.captures
+	if e.lookups != nil {
+		pools = &e.lookups.captures
+	}
+	pool := &pools[0]
+	if strict {
+		pool = &pools[1]
+	}
+	captured, _ := pool.Get().(*capture)
+	if captured == nil {
+		captured = e.newCapture(strict, e.lookups)
+	}
+
+	err := captured.tmpl.Execute(ioutil.Discard, src)
+	val := captured.value
+	captured.value = nil
+	pool.Put(captured)
+	if err != nil {
+		return Value{}, newEvalError(e.key, err)
+	}
+	return newValue(val, mode), nil
+}
@@ -0,0 +1,128 @@
+package data
+
+import (
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"sync"
+	"testing"
+)
+
+func TestValue(t *testing.T) {
+	datum := &Datum{}
+	datum.SetSource(dm, "")
+
+	Convey("Typed values", t, func() {
+		Convey("Have the kind of what the action evaluates to", func() {
+			kinds := []struct {
+				key  string
+				kind int
+				text string
+			}{
+				{"{{.a}}", VALUE_NUMBER, "10"},
+				{"{{.b.c}}", VALUE_NUMBER, "2.5"},
+				{"{{add .a .v}}", VALUE_DECIMAL, "10.1"},
+				{"{{.e}}", VALUE_STRING, "bar"},
+				{"{{.j}}", VALUE_BOOL, "true"},
+				{"{{eq .a 10}}", VALUE_BOOL, "true"},
+				{"{{.h}}", VALUE_TIME, now.String()},
+				{"{{.boof}}", VALUE_NULL, ""},
+				{"{{.boof.bloop}}", VALUE_NULL, ""},
+				{"{{.u}}", VALUE_STRING, "[a b c]"},
+				{"a is {{.a}}", VALUE_STRING, "a is 10"},
+				{"{{if .j}}{{.a}}{{end}}", VALUE_STRING, "10"},
+				{"e", VALUE_STRING, "e"},
+			}
+			for _, k := range kinds {
+				val, err := datum.GetValue(k.key, "")
+				So(err, ShouldEqual, nil)
+				So(val.Kind, ShouldEqual, k.kind)
+				So(val.String(), ShouldEqual, k.text)
+			}
+
+			val, _ := datum.GetValue("{{.a}}", "")
+			So(val.Interface(), ShouldEqual, 10)
+			val, _ = datum.GetValue("{{.h}}", "")
+			So(val.Interface(), ShouldEqual, now)
+			val, _ = datum.GetValue("{{.boof}}", "")
+			So(val.IsNull(), ShouldEqual, true)
+		})
+
+		Convey("Convert to decimals, times and bools", func() {
+			val, _ := datum.GetValue("{{.q}}", "")
+			d, err := val.Decimal()
+			So(err, ShouldEqual, nil)
+			So(d.String(), ShouldEqual, "-12.5")
+
+			val, _ = datum.GetValue("{{.v}}", "")
+			d, _ = val.Decimal()
+			So(d.String(), ShouldEqual, "0.1")
+
+			val, _ = datum.GetValue("{{.e}}", "")
+			_, err = val.Decimal()
+			So(err, ShouldNotEqual, nil)
+
+			val, _ = datum.GetValue(`{{"2015-06-14"}}`, "")
+			tm, err := val.Time()
+			So(err, ShouldEqual, nil)
+			So(tm.Year(), ShouldEqual, 2015)
+
+			val, _ = datum.GetValue("{{.k}}", "")
+			So(val.Bool(), ShouldEqual, false)
+		})
+
+		Convey("Are escaped when printed", func() {
+			escaped := &Datum{Escape: ESCAPE_XML}
+			escaped.SetSource(dm, "")
+			val, err := escaped.GetValue("{{.n}}", "")
+			So(err, ShouldEqual, nil)
+			So(val.String(), ShouldEqual, "AT&amp;T")
+			So(val.Interface(), ShouldEqual, "AT&T")
+		})
+
+		Convey("Fall back to the default", func() {
+			val, err := datum.GetValue("{{.boof}}", "{{.a}}")
+			So(err, ShouldEqual, nil)
+			So(val.Kind, ShouldEqual, VALUE_NUMBER)
+			So(val.String(), ShouldEqual, "10")
+		})
+
+		Convey("Use lookup tables", func() {
+			expr, _ := Compile(`{{lookup "rates" .e}}`)
+			val, err := expr.WithLookups(Lookups{"rates": {"bar": NewDecimal(125, 2)}}).EvalValue(dm)
+			So(err, ShouldEqual, nil)
+			So(val.Kind, ShouldEqual, VALUE_DECIMAL)
+			So(val.String(), ShouldEqual, "1.25")
+		})
+
+		Convey("Return errors", func() {
+			_, err := datum.GetValue("{{.a.b}}", "")
+			So(err, ShouldHaveSameTypeAs, &EvalError{})
+			_, err = datum.GetValue("{{.a", "")
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Can be evaluated concurrently", func() {
+			expr, _ := Compile("{{add .a .d}}")
+			var wg sync.WaitGroup
+			results := make([]string, 20)
+			for i := range results {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					val, _ := expr.EvalValue(map[string]interface{}{"a": i, "d": 1})
+					results[i] = val.String()
+				}(i)
+			}
+			wg.Wait()
+			for i, result := range results {
+				So(result, ShouldEqual, fmt.Sprint(i+1))
+			}
+		})
+
+		Convey("Can be made from anything", func() {
+			So(NewValue(nil).Kind, ShouldEqual, VALUE_NULL)
+			So(NewValue(int64(3)).Kind, ShouldEqual, VALUE_NUMBER)
+			So(NewValue(map[string]interface{}{}).Kind, ShouldEqual, VALUE_STRING)
+		})
+	})
+}
@@ -0,0 +1,34 @@
+package delivery
+
+import (
+	"errors"
+)
+
+// A PermanentError is a delivery failure that won't go away by trying again,
+// like bad credentials or a missing path
+type PermanentError struct {
+	Err error
+}
+
+func (p *PermanentError) Error() string {
+	return p.Err.Error()
+}
+
+func (p *PermanentError) Unwrap() error {
+	return p.Err
+}
+
+// Permanent marks err as not worth retrying
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{err}
+}
+
+// IsPermanent says whether err, or any error it wraps, was marked with
+// Permanent
+func IsPermanent(err error) bool {
+	var permanent *PermanentError
+	return errors.As(err, &permanent)
+}
@@ -0,0 +1,175 @@
+// Delivery module that writes to the local filesystem, for archiving or for
+// partners that pick files up from a mounted share.
+//
+// The data is written to a temporary file next to the destination, synced to
+// disk and then renamed into place, so nobody ever sees a partial file.
+
+package file
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/maxwellhealth/emissary/delivery"
+	"github.com/maxwellhealth/emissary/internal/ctxio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Most names to try when looking for one that doesn't collide
+const maxCollisions = 10000
+
+type PathFunc func() string
+
+type File struct {
+	// If path is provided, then it will be used. Otherwise it will delegate to PathFunc.
+	// Either may contain EDL (see delivery.ResolvePath).
+	Path     string
+	PathFunc PathFunc
+
+	// Permissions of the file. Defaults to 0644.
+	Mode os.FileMode
+	// Permissions of parent directories that have to be created. Defaults
+	// to 0755.
+	DirMode os.FileMode
+
+	// If true, fail rather than replace a file that is already there
+	NoOverwrite bool
+	// If set, a file that is already there is never replaced. Instead this is
+	// added to the name, before the extension, to find one that's free. It
+	// must contain a single %d, which counts up from 1; e.g. "-%d" turns
+	// census.csv into census-1.csv, census-2.csv...
+	CollisionSuffix string
+
+	destination string
+}
+
+// Destination returns the URL of the file most recently delivered
+func (f *File) Destination() string {
+	return f.destination
+}
+
+func (f *File) Deliver(r io.Reader) error {
+	return f.DeliverContext(context.Background(), r)
+}
+
+// DeliverContext is the same as Deliver, but stops writing once ctx is done
+func (f *File) DeliverContext(ctx context.Context, r io.Reader) error {
+	// Determine the path
+	path, err := delivery.ResolvePath(ctx, f.Path, f.PathFunc)
+	if err != nil {
+		return err
+	}
+
+	if len(f.CollisionSuffix) > 0 && strings.Count(f.CollisionSuffix, "%d") != 1 {
+		return delivery.Permanent(errors.New("Collision suffix must contain a single %d"))
+	}
+
+	mode := f.Mode
+	if mode == 0 {
+		mode = 0644
+	}
+	dirMode := f.DirMode
+	if dirMode == 0 {
+		dirMode = 0755
+	}
+
+	dir := filepath.Dir(path)
+	err = os.MkdirAll(dir, dirMode)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	// Once the file is in place this fails harmlessly
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, ctxio.NewReader(ctx, r))
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(f.CollisionSuffix) > 0 {
+		path, err = placeUnique(tmp.Name(), path, f.CollisionSuffix)
+	} else if f.NoOverwrite {
+		err = place(tmp.Name(), path)
+	} else {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return err
+	}
+
+	syncDir(dir)
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	f.destination = "file://" + filepath.ToSlash(abs)
+	return nil
+}
+
+// Moves tmp to path, failing if path already exists
+func place(tmp string, path string) error {
+	// Hard linking fails if the name is taken, so there's no window for
+	// another process to sneak a file in between checking and renaming
+	err := os.Link(tmp, path)
+	if err == nil || os.IsExist(err) {
+		return err
+	}
+
+	// The filesystem doesn't do hard links. Fall back to checking first.
+	_, statErr := os.Lstat(path)
+	if statErr == nil {
+		return &os.LinkError{Op: "rename", Old: tmp, New: path, Err: os.ErrExist}
+	} else if !os.IsNotExist(statErr) {
+		return statErr
+	}
+	return os.Rename(tmp, path)
+}
+
+// Moves tmp to path, or to the first name made with suffix that is free.
+// Returns the path used.
+func placeUnique(tmp string, path string, suffix string) (string, error) {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+
+	candidate := path
+	for n := 1; n <= maxCollisions; n++ {
+		err := place(tmp, candidate)
+		if err == nil {
+			return candidate, nil
+		} else if !os.IsExist(err) {
+			return "", err
+		}
+		candidate = base + fmt.Sprintf(suffix, n) + ext
+	}
+	return "", errors.New("No free file name found for " + path)
+}
+
+// Makes the rename itself durable. Not every platform can sync a directory,
+// and the file is already in place, so errors are ignored.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
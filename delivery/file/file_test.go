@@ -0,0 +1,133 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"github.com/maxwellhealth/emissary/delivery"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type errReader struct {
+	err error
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	return 0, e.err
+}
+
+func TestFile(t *testing.T) {
+	Convey("File", t, func() {
+		dir, err := ioutil.TempDir("", "emissary-file")
+		So(err, ShouldEqual, nil)
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "outbound", "2015", "census.csv")
+		mod := &File{Path: path}
+
+		read := func(p string) string {
+			contents, err := ioutil.ReadFile(p)
+			So(err, ShouldEqual, nil)
+			return string(contents)
+		}
+
+		Convey("Writes the file, creating parent directories", func() {
+			err := mod.Deliver(strings.NewReader("census data"))
+			So(err, ShouldEqual, nil)
+			So(read(path), ShouldEqual, "census data")
+			So(mod.Destination(), ShouldEqual, "file://"+filepath.ToSlash(path))
+
+			info, err := os.Stat(path)
+			So(err, ShouldEqual, nil)
+			So(info.Mode().Perm(), ShouldEqual, os.FileMode(0644))
+
+			// Nothing left lying around
+			files, err := ioutil.ReadDir(filepath.Dir(path))
+			So(err, ShouldEqual, nil)
+			So(len(files), ShouldEqual, 1)
+		})
+
+		Convey("Uses the PathFunc and Mode", func() {
+			mod.Path = ""
+			mod.PathFunc = func() string {
+				return filepath.Join(dir, "from-func.csv")
+			}
+			mod.Mode = 0600
+
+			err := mod.Deliver(strings.NewReader("census data"))
+			So(err, ShouldEqual, nil)
+
+			info, err := os.Stat(filepath.Join(dir, "from-func.csv"))
+			So(err, ShouldEqual, nil)
+			So(info.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+		})
+
+		Convey("Builds the path from the run", func() {
+			mod.Path = filepath.Join(dir, `{{date .now "20060102"}}`, "{{.emissary}}_{{.fileName}}")
+			ctx := delivery.WithRunInfo(context.Background(), delivery.RunInfo{
+				Time:     time.Date(2015, 6, 1, 8, 30, 0, 0, time.UTC),
+				Emissary: "acme",
+				FileName: "census.csv",
+			})
+
+			err := mod.DeliverContext(ctx, strings.NewReader("census data"))
+			So(err, ShouldEqual, nil)
+			So(read(filepath.Join(dir, "20150601", "acme_census.csv")), ShouldEqual, "census data")
+		})
+
+		Convey("Requires a path", func() {
+			mod.Path = ""
+			err := mod.Deliver(strings.NewReader("census data"))
+			So(delivery.IsPermanent(err), ShouldEqual, true)
+		})
+
+		Convey("Replaces an existing file by default", func() {
+			So(mod.Deliver(strings.NewReader("old")), ShouldEqual, nil)
+			So(mod.Deliver(strings.NewReader("new")), ShouldEqual, nil)
+			So(read(path), ShouldEqual, "new")
+		})
+
+		Convey("Refuses to overwrite", func() {
+			mod.NoOverwrite = true
+			So(mod.Deliver(strings.NewReader("old")), ShouldEqual, nil)
+			err := mod.Deliver(strings.NewReader("new"))
+			So(os.IsExist(err), ShouldEqual, true)
+			So(read(path), ShouldEqual, "old")
+		})
+
+		Convey("Adds a suffix when the name is taken", func() {
+			mod.CollisionSuffix = "-%d"
+			for _, contents := range []string{"first", "second", "third"} {
+				So(mod.Deliver(strings.NewReader(contents)), ShouldEqual, nil)
+			}
+
+			base := filepath.Dir(path)
+			So(read(path), ShouldEqual, "first")
+			So(read(filepath.Join(base, "census-1.csv")), ShouldEqual, "second")
+			So(read(filepath.Join(base, "census-2.csv")), ShouldEqual, "third")
+			So(mod.Destination(), ShouldEqual, "file://"+filepath.ToSlash(filepath.Join(base, "census-2.csv")))
+		})
+
+		Convey("Rejects a suffix without a counter", func() {
+			mod.CollisionSuffix = "-copy"
+			err := mod.Deliver(strings.NewReader("census data"))
+			So(delivery.IsPermanent(err), ShouldEqual, true)
+		})
+
+		Convey("Leaves nothing behind when the input fails", func() {
+			readErr := errors.New("generator blew up")
+			err := mod.Deliver(io.MultiReader(strings.NewReader("partial"), &errReader{readErr}))
+			So(err, ShouldEqual, readErr)
+
+			files, err := ioutil.ReadDir(filepath.Dir(path))
+			So(err, ShouldEqual, nil)
+			So(len(files), ShouldEqual, 0)
+		})
+	})
+}
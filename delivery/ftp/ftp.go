@@ -6,11 +6,17 @@
 package ftp
 
 import (
+	"context"
 	"errors"
 	jftp "github.com/jlaffaye/ftp"
+	"github.com/maxwellhealth/emissary/delivery"
+	"github.com/maxwellhealth/emissary/internal/ctxio"
 	"io"
+	"net"
+	"net/textproto"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -26,37 +32,87 @@ type FTP struct {
 	// Timeout, in seconds
 	Timeout int
 
-	// If path is provided, then it will be used. Otherwise it will delegate to PathFunc
+	// If path is provided, then it will be used. Otherwise it will delegate to PathFunc.
+	// Either may contain EDL (see delivery.ResolvePath).
 	Path     string
 	PathFunc PathFunc
+
+	destination string
+}
+
+// Destination returns the URL of the file most recently delivered
+func (f *FTP) Destination() string {
+	return f.destination
 }
 
 func (f *FTP) Deliver(r io.Reader) error {
+	return f.DeliverContext(context.Background(), r)
+}
+
+// DeliverContext is the same as Deliver, but gives up once ctx is done. The
+// dial timeout is shortened to the context's deadline if that comes sooner,
+// and the connections are closed if ctx is done during the upload.
+func (f *FTP) DeliverContext(ctx context.Context, r io.Reader) error {
+	err := f.deliver(ctx, r)
+	if err != nil && ctx.Err() != nil {
+		// Whatever broke, it broke because we gave up
+		return ctx.Err()
+	}
+	return err
+}
+
+func (f *FTP) deliver(ctx context.Context, r io.Reader) error {
 	if f.Timeout == 0 {
 		// Default to 5 second timeout
 		f.Timeout = 5
 	}
 
-	conn, err := jftp.DialTimeout(f.Address, time.Duration(f.Timeout)*time.Second)
+	// The dialer stops at the context's deadline if that comes sooner
+	dialer := &net.Dialer{Timeout: time.Duration(f.Timeout) * time.Second}
+	conns := &connections{}
+	conn, err := jftp.Dial(f.Address, jftp.DialWithDialFunc(func(network, address string) (net.Conn, error) {
+		c, err := dialer.DialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		if err := conns.add(c); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}))
 
 	if err != nil {
 		return err
 	}
+	defer conn.Quit()
+
+	// The session can only be used by one goroutine at a time, so rather than
+	// hanging up, stop whatever command is running by closing its connections
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conns.close()
+		case <-finished:
+		}
+	}()
 
 	// Login
 	err = conn.Login(f.Username, f.Password)
 	if err != nil {
+		var reply *textproto.Error
+		if errors.As(err, &reply) && reply.Code == jftp.StatusNotLoggedIn {
+			// Wrong username or password, which trying again won't fix
+			return delivery.Permanent(err)
+		}
 		return err
 	}
 
-	var path string
 	// Determine the path
-	if len(f.Path) > 0 {
-		path = f.Path
-	} else if f.PathFunc != nil {
-		path = f.PathFunc()
-	} else {
-		return errors.New("Missing path and path func")
+	path, err := delivery.ResolvePath(ctx, f.Path, f.PathFunc)
+	if err != nil {
+		return err
 	}
 
 	// Create the path if necessary...
@@ -84,9 +140,42 @@ func (f *FTP) Deliver(r io.Reader) error {
 				return err
 			}
 		}
+	}
+	err = conn.Stor(filepath.Base(path), ctxio.NewReader(ctx, r))
+	if err != nil {
+		return err
+	}
+
+	f.destination = "ftp://" + f.Address + "/" + strings.TrimPrefix(path, "/")
+	return nil
 
-		path = filepath.Base(path)
+}
+
+// The network connections of an FTP session. Unlike the session, they can be
+// closed from another goroutine.
+type connections struct {
+	mu     sync.Mutex
+	conns  []net.Conn
+	closed bool
+}
+
+// Keeps track of a new connection, or closes it if the rest already have been
+func (c *connections) add(conn net.Conn) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		conn.Close()
+		return errors.New("Connection closed")
 	}
-	return conn.Stor(path, r)
+	c.conns = append(c.conns, conn)
+	return nil
+}
 
+func (c *connections) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, conn := range c.conns {
+		conn.Close()
+	}
 }
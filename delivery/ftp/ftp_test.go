@@ -0,0 +1,164 @@
+package ftp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/maxwellhealth/emissary/delivery"
+	"github.com/maxwellhealth/emissary/delivery/retry"
+	. "github.com/smartystreets/goconvey/convey"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// FTP server that turns down every password, counting the connections
+func refusingServer() (net.Listener, *int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	var connections int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&connections, 1)
+			go func() {
+				defer conn.Close()
+				fmt.Fprint(conn, "220 Ready\r\n")
+				lines := bufio.NewScanner(conn)
+				for lines.Scan() {
+					switch strings.Fields(lines.Text())[0] {
+					case "USER":
+						fmt.Fprint(conn, "331 Password required\r\n")
+					case "PASS":
+						fmt.Fprint(conn, "530 Login incorrect\r\n")
+					case "QUIT":
+						fmt.Fprint(conn, "221 Bye\r\n")
+						return
+					default:
+						fmt.Fprint(conn, "502 Not implemented\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	return listener, &connections
+}
+
+// FTP server that takes any login, then never reads what's uploaded
+func stallingServer() net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					return
+				}
+				defer data.Close()
+
+				fmt.Fprint(conn, "220 Ready\r\n")
+				lines := bufio.NewScanner(conn)
+				for lines.Scan() {
+					switch strings.Fields(lines.Text())[0] {
+					case "USER":
+						fmt.Fprint(conn, "331 Password required\r\n")
+					case "PASS":
+						fmt.Fprint(conn, "230 Logged in\r\n")
+					case "TYPE":
+						fmt.Fprint(conn, "200 OK\r\n")
+					case "EPSV":
+						port := data.Addr().(*net.TCPAddr).Port
+						fmt.Fprintf(conn, "229 Entering Extended Passive Mode (|||%d|)\r\n", port)
+					case "STOR":
+						stalled, err := data.Accept()
+						if err != nil {
+							return
+						}
+						defer stalled.Close()
+						fmt.Fprint(conn, "150 Go ahead\r\n")
+					case "QUIT":
+						fmt.Fprint(conn, "221 Bye\r\n")
+						return
+					default:
+						fmt.Fprint(conn, "502 Not implemented\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestFTP(t *testing.T) {
+	Convey("FTP", t, func() {
+		Convey("Doesn't retry when the login is turned down", func() {
+			listener, connections := refusingServer()
+			defer listener.Close()
+
+			mod := &retry.Retry{
+				Module: &FTP{
+					Username: "jane",
+					Password: "wrong",
+					Address:  listener.Addr().String(),
+					Path:     "out.csv",
+				},
+				InitialBackoff: time.Millisecond,
+			}
+			err := mod.Deliver(strings.NewReader("a,b,c"))
+			So(err, ShouldNotEqual, nil)
+			So(delivery.IsPermanent(err), ShouldBeTrue)
+			So(atomic.LoadInt32(connections), ShouldEqual, 1)
+		})
+
+		Convey("Stops an upload the server has stalled once the context is done", func() {
+			listener := stallingServer()
+			defer listener.Close()
+
+			mod := &FTP{
+				Username: "jane",
+				Password: "right",
+				Address:  listener.Addr().String(),
+				Path:     "out.csv",
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			done := make(chan error, 1)
+			go func() {
+				done <- mod.DeliverContext(ctx, zeros{})
+			}()
+			var err error
+			select {
+			case err = <-done:
+			case <-time.After(5 * time.Second):
+				err = errors.New("Still uploading")
+			}
+			So(err, ShouldEqual, context.DeadlineExceeded)
+		})
+	})
+}
@@ -1,9 +1,32 @@
 package delivery
 
 import (
+	"context"
+	"github.com/maxwellhealth/emissary/internal/ctxio"
 	"io"
 )
 
 type Module interface {
 	Deliver(io.Reader) error
 }
+
+// A ContextModule is a delivery module that can be stopped through a context
+type ContextModule interface {
+	Module
+	DeliverContext(context.Context, io.Reader) error
+}
+
+// A Describer is a delivery module that can say where it delivered the file
+// the last time it ran, e.g. "sftp://example.com:22/outbound/census.csv"
+type Describer interface {
+	Destination() string
+}
+
+// DeliverContext runs m with ctx. Modules that don't implement ContextModule
+// are given a reader that fails once ctx is done.
+func DeliverContext(ctx context.Context, m Module, r io.Reader) error {
+	if cm, ok := m.(ContextModule); ok {
+		return cm.DeliverContext(ctx, r)
+	}
+	return m.Deliver(ctxio.NewReader(ctx, r))
+}
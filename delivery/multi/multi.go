@@ -0,0 +1,193 @@
+// Delivery module that sends the same file to several destinations at once,
+// e.g. a partner's SFTP drop and a local archive.
+//
+// The data is streamed to every destination as it is read, so it is never
+// held in memory in full. A slow destination slows down the others.
+
+package multi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/maxwellhealth/emissary/delivery"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// Every destination must succeed. The first failure stops the others.
+	POLICY_ALL = iota
+	// Carry on delivering to the rest when a destination fails, but fail if
+	// any of them did
+	POLICY_BEST_EFFORT
+	// Carry on delivering to the rest when a destination fails, and only
+	// fail if all of them did
+	POLICY_AT_LEAST_ONE
+)
+
+// ErrAbandoned is the error recorded for destinations that were stopped
+// because another destination failed under POLICY_ALL
+var ErrAbandoned = errors.New("multi: abandoned after another destination failed")
+
+type Multi struct {
+	Modules []delivery.Module
+	Policy  int
+
+	destinations []string
+}
+
+// A Failure is a single destination that failed
+type Failure struct {
+	// Index of the module in Modules
+	Index  int
+	Module delivery.Module
+	Err    error
+}
+
+func (f *Failure) Error() string {
+	return "destinations[" + strconv.Itoa(f.Index) + "] (" + fmt.Sprintf("%T", f.Module) + "): " + f.Err.Error()
+}
+
+// An Error reports every destination that failed
+type Error struct {
+	Failures     []*Failure
+	Destinations int
+}
+
+func (e *Error) Error() string {
+	msgs := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		msgs[i] = f.Error()
+	}
+	return strconv.Itoa(len(e.Failures)) + " of " + strconv.Itoa(e.Destinations) + " destinations failed: " + strings.Join(msgs, "; ")
+}
+
+// Destination returns the destinations of the modules that succeeded the last
+// time, separated by commas
+func (m *Multi) Destination() string {
+	return strings.Join(m.destinations, ", ")
+}
+
+func (m *Multi) Deliver(r io.Reader) error {
+	return m.DeliverContext(context.Background(), r)
+}
+
+func (m *Multi) DeliverContext(ctx context.Context, r io.Reader) error {
+	m.destinations = nil
+	if len(m.Modules) == 0 {
+		return errors.New("multi: no destinations")
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	count := len(m.Modules)
+	errs := make([]error, count)
+	readers := make([]*io.PipeReader, count)
+	writers := make([]*io.PipeWriter, count)
+	for i := range readers {
+		readers[i], writers[i] = io.Pipe()
+	}
+
+	var abandon sync.Once
+	var wg sync.WaitGroup
+	wg.Add(count)
+
+	for i, mod := range m.Modules {
+		go func(i int, mod delivery.Module) {
+			defer wg.Done()
+
+			err := delivery.DeliverContext(ctx, mod, readers[i])
+			errs[i] = err
+
+			// Unblock the tee whether or not this destination read everything
+			readers[i].CloseWithError(err)
+
+			if err != nil && m.Policy == POLICY_ALL {
+				abandon.Do(func() {
+					cancel()
+					for j := range writers {
+						if j != i {
+							writers[j].CloseWithError(ErrAbandoned)
+						}
+					}
+				})
+			}
+		}(i, mod)
+	}
+
+	readErr := tee(r, writers)
+	for _, w := range writers {
+		w.CloseWithError(readErr)
+	}
+	wg.Wait()
+
+	if err := parent.Err(); err != nil {
+		return err
+	}
+	if readErr != nil {
+		return readErr
+	}
+
+	// The first failure under POLICY_ALL is the real one; the rest were
+	// stopped on purpose
+	var failures []*Failure
+	for i, err := range errs {
+		if err == nil {
+			if describer, ok := m.Modules[i].(delivery.Describer); ok {
+				m.destinations = append(m.destinations, describer.Destination())
+			}
+			continue
+		}
+		if m.Policy == POLICY_ALL && (err == context.Canceled || err == io.ErrClosedPipe) && ctx.Err() != nil {
+			err = ErrAbandoned
+		}
+		failures = append(failures, &Failure{i, m.Modules[i], err})
+	}
+
+	if len(failures) == 0 {
+		return nil
+	}
+	if m.Policy == POLICY_AT_LEAST_ONE && len(failures) < count {
+		return nil
+	}
+	return &Error{failures, count}
+}
+
+// Copies r to every writer until r runs out or none of the writers are left.
+// Writers that fail are dropped. Returns the error from reading r, if any.
+func tee(r io.Reader, writers []*io.PipeWriter) error {
+	live := make([]bool, len(writers))
+	remaining := len(writers)
+	for i := range live {
+		live[i] = true
+	}
+
+	buf := make([]byte, 32*1024)
+	for remaining > 0 {
+		n, err := r.Read(buf)
+		if n > 0 {
+			for i, w := range writers {
+				if !live[i] {
+					continue
+				}
+				_, werr := w.Write(buf[:n])
+				if werr != nil {
+					live[i] = false
+					remaining--
+				}
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package multi
+
+import (
+	"errors"
+	"github.com/maxwellhealth/emissary/delivery"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"strings"
+	"testing"
+)
+
+type failing struct {
+	err error
+}
+
+func (f *failing) Deliver(r io.Reader) error {
+	return f.err
+}
+
+// Reads the whole input and says where it went
+type described struct {
+	delivery.Mock
+	name string
+}
+
+func (d *described) Destination() string {
+	return d.name
+}
+
+func TestMulti(t *testing.T) {
+	Convey("Multi", t, func() {
+		// Big enough to take several reads
+		data := strings.Repeat("member,plan,premium\n", 10000)
+
+		archive := &described{name: "file:///archive/census.csv"}
+		partner := &described{name: "sftp://partner/census.csv"}
+		broken := &failing{errors.New("connection refused")}
+
+		Convey("Sends the same data to every destination", func() {
+			mod := &Multi{Modules: []delivery.Module{archive, partner}}
+			err := mod.Deliver(strings.NewReader(data))
+			So(err, ShouldEqual, nil)
+			So(string(archive.Data), ShouldEqual, data)
+			So(string(partner.Data), ShouldEqual, data)
+			So(mod.Destination(), ShouldEqual, "file:///archive/census.csv, sftp://partner/census.csv")
+		})
+
+		Convey("With POLICY_ALL", func() {
+			mod := &Multi{Modules: []delivery.Module{archive, broken}, Policy: POLICY_ALL}
+			err := mod.Deliver(strings.NewReader(data))
+			So(err, ShouldNotEqual, nil)
+
+			multiErr := err.(*Error)
+			So(multiErr.Failures[len(multiErr.Failures)-1].Index, ShouldEqual, 1)
+			So(multiErr.Failures[len(multiErr.Failures)-1].Err, ShouldEqual, broken.err)
+			So(err.Error(), ShouldContainSubstring, "destinations[1] (*multi.failing): connection refused")
+
+			// The archive was stopped part way, unless it managed to finish first
+			if len(multiErr.Failures) == 2 {
+				So(multiErr.Failures[0].Err, ShouldEqual, ErrAbandoned)
+			}
+		})
+
+		Convey("With POLICY_BEST_EFFORT", func() {
+			mod := &Multi{Modules: []delivery.Module{broken, archive, partner}, Policy: POLICY_BEST_EFFORT}
+			err := mod.Deliver(strings.NewReader(data))
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldEqual, "1 of 3 destinations failed: destinations[0] (*multi.failing): connection refused")
+			So(string(archive.Data), ShouldEqual, data)
+			So(string(partner.Data), ShouldEqual, data)
+		})
+
+		Convey("With POLICY_AT_LEAST_ONE", func() {
+			mod := &Multi{Modules: []delivery.Module{broken, archive}, Policy: POLICY_AT_LEAST_ONE}
+			err := mod.Deliver(strings.NewReader(data))
+			So(err, ShouldEqual, nil)
+			So(string(archive.Data), ShouldEqual, data)
+			So(mod.Destination(), ShouldEqual, "file:///archive/census.csv")
+
+			mod.Modules = []delivery.Module{broken, &failing{errors.New("disk full")}}
+			err = mod.Deliver(strings.NewReader(data))
+			So(err, ShouldNotEqual, nil)
+			So(len(err.(*Error).Failures), ShouldEqual, 2)
+		})
+
+		Convey("Fails every destination when the input fails", func() {
+			readErr := errors.New("generator blew up")
+			mod := &Multi{Modules: []delivery.Module{archive, partner}, Policy: POLICY_BEST_EFFORT}
+			err := mod.Deliver(io.MultiReader(strings.NewReader(data), &errReader{readErr}))
+			So(err, ShouldEqual, readErr)
+		})
+	})
+}
+
+type errReader struct {
+	err error
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	return 0, e.err
+}
+
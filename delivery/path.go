@@ -0,0 +1,74 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/maxwellhealth/emissary/data"
+	"strings"
+	"time"
+)
+
+// RunInfo describes the run that a delivery is part of. Emissary.RunContext
+// attaches it to the context it passes to DeliverContext.
+type RunInfo struct {
+	Time     time.Time
+	Emissary string
+	FileName string
+	// Counts the emissary's runs since the process started, from 1
+	Sequence int
+}
+
+type runInfoKey struct{}
+
+// WithRunInfo returns a copy of ctx that carries info
+func WithRunInfo(ctx context.Context, info RunInfo) context.Context {
+	return context.WithValue(ctx, runInfoKey{}, info)
+}
+
+// RunInfoFrom returns the run info carried by ctx, if there is any
+func RunInfoFrom(ctx context.Context) (RunInfo, bool) {
+	info, ok := ctx.Value(runInfoKey{}).(RunInfo)
+	return info, ok
+}
+
+// ResolvePath works out where a delivery module should put the file. If path
+// is empty, pathFunc is called instead. Either way, a path that contains
+// EDL (e.g. `outbound/{{date .now "20060102"}}/{{.emissary}}.csv`) is
+// evaluated against the run info in ctx, which is available as .now,
+// .emissary, .fileName and .sequence. Without run info, .now is the current
+// time.
+func ResolvePath(ctx context.Context, path string, pathFunc func() string) (string, error) {
+	if len(path) == 0 {
+		if pathFunc == nil {
+			return "", Permanent(errors.New("Missing path and path func"))
+		}
+		path = pathFunc()
+	}
+
+	if !strings.Contains(path, "{{") {
+		return path, nil
+	}
+
+	info, ok := RunInfoFrom(ctx)
+	if !ok {
+		info.Time = time.Now()
+	}
+
+	datum := &data.Datum{}
+	datum.SetSource(map[string]interface{}{
+		"now":      info.Time,
+		"emissary": info.Emissary,
+		"fileName": info.FileName,
+		"sequence": info.Sequence,
+	}, "")
+
+	resolved, err := datum.GetE(path, "")
+	if err != nil {
+		return "", Permanent(err)
+	}
+	if len(resolved) == 0 {
+		return "", Permanent(fmt.Errorf("Path template %q evaluated to an empty path", path))
+	}
+	return resolved, nil
+}
@@ -0,0 +1,55 @@
+package delivery
+
+import (
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestResolvePath(t *testing.T) {
+	Convey("ResolvePath", t, func() {
+		ctx := WithRunInfo(context.Background(), RunInfo{
+			Time:     time.Date(2015, 6, 1, 8, 30, 0, 0, time.UTC),
+			Emissary: "acme",
+			FileName: "census.csv",
+			Sequence: 3,
+		})
+
+		Convey("Leaves plain paths alone", func() {
+			path, err := ResolvePath(ctx, "outbound/census.csv", nil)
+			So(err, ShouldEqual, nil)
+			So(path, ShouldEqual, "outbound/census.csv")
+		})
+
+		Convey("Evaluates EDL against the run", func() {
+			path, err := ResolvePath(ctx, `outbound/{{date .now "20060102"}}/{{.emissary}}_{{.sequence}}_{{.fileName}}`, nil)
+			So(err, ShouldEqual, nil)
+			So(path, ShouldEqual, "outbound/20150601/acme_3_census.csv")
+		})
+
+		Convey("Evaluates the path func's result too", func() {
+			path, err := ResolvePath(ctx, "", func() string {
+				return "{{.emissary}}.csv"
+			})
+			So(err, ShouldEqual, nil)
+			So(path, ShouldEqual, "acme.csv")
+		})
+
+		Convey("Uses the current time without run info", func() {
+			path, err := ResolvePath(context.Background(), `{{date .now "2006"}}.csv`, nil)
+			So(err, ShouldEqual, nil)
+			So(path, ShouldEqual, time.Now().Format("2006")+".csv")
+		})
+
+		Convey("Fails permanently without a path", func() {
+			_, err := ResolvePath(ctx, "", nil)
+			So(IsPermanent(err), ShouldEqual, true)
+		})
+
+		Convey("Fails permanently on a bad template", func() {
+			_, err := ResolvePath(ctx, "{{.emissary", nil)
+			So(IsPermanent(err), ShouldEqual, true)
+		})
+	})
+}
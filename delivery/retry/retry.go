@@ -0,0 +1,165 @@
+// Delivery module that retries another delivery module when it fails.
+//
+// The input is spooled to a temporary file first, so the same data can be
+// sent again on every attempt. Attempts are spaced out with exponential
+// backoff, and each wait is randomised a little so that many emissaries
+// failing at once don't all retry at the same moment.
+
+package retry
+
+import (
+	"context"
+	"github.com/maxwellhealth/emissary/delivery"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	DefaultMaxAttempts    = 3
+	DefaultInitialBackoff = time.Second
+	DefaultMaxBackoff     = time.Minute
+)
+
+type Retry struct {
+	Module delivery.Module
+
+	// Most attempts to make, including the first. Defaults to
+	// DefaultMaxAttempts.
+	MaxAttempts int
+	// Give up rather than wait for another attempt once this long has passed
+	// since the first one started. Zero means no limit.
+	MaxElapsed time.Duration
+
+	// Wait before the second attempt, doubled for every attempt after that
+	// up to MaxBackoff. Default to DefaultInitialBackoff and
+	// DefaultMaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// Decides whether an error is worth another attempt. Defaults to
+	// Retryable.
+	Retryable func(error) bool
+	// Called before waiting for each retry. Optional.
+	OnRetry func(attempt int, err error, wait time.Duration)
+}
+
+// An Error is returned once the wrapped module has failed for good
+type Error struct {
+	Attempts int
+	// The error from the last attempt
+	Err error
+}
+
+func (e *Error) Error() string {
+	return "delivery failed after " + strconv.Itoa(e.Attempts) + " attempt(s): " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Retryable treats errors marked with delivery.Permanent and errors from a
+// finished context as permanent, and everything else as worth retrying.
+func Retryable(err error) bool {
+	if delivery.IsPermanent(err) {
+		return false
+	}
+	return err != context.Canceled && err != context.DeadlineExceeded
+}
+
+// Destination returns the wrapped module's destination, if it has one
+func (r *Retry) Destination() string {
+	if describer, ok := r.Module.(delivery.Describer); ok {
+		return describer.Destination()
+	}
+	return ""
+}
+
+func (r *Retry) Deliver(rd io.Reader) error {
+	return r.DeliverContext(context.Background(), rd)
+}
+
+// DeliverContext is the same as Deliver, but stops retrying once ctx is done
+func (r *Retry) DeliverContext(ctx context.Context, rd io.Reader) error {
+	spool, err := delivery.Spool(rd)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	maxAttempts := r.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = DefaultMaxAttempts
+	}
+	retryable := r.Retryable
+	if retryable == nil {
+		retryable = Retryable
+	}
+
+	started := time.Now()
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			_, err = spool.Seek(0, io.SeekStart)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = delivery.DeliverContext(ctx, r.Module, spool)
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= maxAttempts || !retryable(err) || ctx.Err() != nil {
+			return &Error{attempt, err}
+		}
+
+		wait := r.backoff(attempt)
+		if r.MaxElapsed > 0 && time.Since(started)+wait > r.MaxElapsed {
+			return &Error{attempt, err}
+		}
+
+		if r.OnRetry != nil {
+			r.OnRetry(attempt, err, wait)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return &Error{attempt, ctx.Err()}
+		}
+	}
+}
+
+// The wait after the given attempt: the full exponential backoff with up to
+// half of it taken off at random
+func (r *Retry) backoff(attempt int) time.Duration {
+	initial := r.InitialBackoff
+	if initial <= 0 {
+		initial = DefaultInitialBackoff
+	}
+	max := r.MaxBackoff
+	if max <= 0 {
+		max = DefaultMaxBackoff
+	}
+
+	wait := initial
+	for i := 1; i < attempt && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+
+	half := int64(wait / 2)
+	if half <= 0 {
+		return wait
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
@@ -0,0 +1,122 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"github.com/maxwellhealth/emissary/delivery"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Delivery module that fails a set number of times before it succeeds
+type flaky struct {
+	failures int
+	err      error
+	attempts int
+	data     []string
+}
+
+func (f *flaky) Deliver(r io.Reader) error {
+	f.attempts++
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	f.data = append(f.data, string(data))
+
+	if f.attempts <= f.failures {
+		return f.err
+	}
+	return nil
+}
+
+func TestRetry(t *testing.T) {
+	Convey("Retry", t, func() {
+		transient := errors.New("connection reset by peer")
+		mod := &flaky{failures: 2, err: transient}
+		retry := &Retry{
+			Module:         mod,
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     5 * time.Millisecond,
+		}
+
+		Convey("Replays the same data on every attempt", func() {
+			err := retry.Deliver(strings.NewReader("census data"))
+			So(err, ShouldEqual, nil)
+			So(mod.attempts, ShouldEqual, 3)
+			So(mod.data, ShouldResemble, []string{"census data", "census data", "census data"})
+		})
+
+		Convey("Stops after MaxAttempts", func() {
+			retry.MaxAttempts = 2
+			var retries []int
+			retry.OnRetry = func(attempt int, err error, wait time.Duration) {
+				retries = append(retries, attempt)
+			}
+
+			err := retry.Deliver(strings.NewReader("census data"))
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldEqual, "delivery failed after 2 attempt(s): connection reset by peer")
+			So(err.(*Error).Err, ShouldEqual, transient)
+			So(mod.attempts, ShouldEqual, 2)
+			So(retries, ShouldResemble, []int{1})
+		})
+
+		Convey("Doesn't retry permanent errors", func() {
+			mod.err = delivery.Permanent(errors.New("Missing path and path func"))
+			err := retry.Deliver(strings.NewReader("census data"))
+			So(err, ShouldNotEqual, nil)
+			So(delivery.IsPermanent(err), ShouldEqual, true)
+			So(mod.attempts, ShouldEqual, 1)
+		})
+
+		Convey("Uses a custom classifier", func() {
+			retry.Retryable = func(err error) bool {
+				return err != transient
+			}
+			err := retry.Deliver(strings.NewReader("census data"))
+			So(err, ShouldNotEqual, nil)
+			So(mod.attempts, ShouldEqual, 1)
+		})
+
+		Convey("Stops once MaxElapsed would be passed", func() {
+			retry.InitialBackoff = time.Hour
+			retry.MaxBackoff = time.Hour
+			retry.MaxElapsed = time.Minute
+			err := retry.Deliver(strings.NewReader("census data"))
+			So(err, ShouldNotEqual, nil)
+			So(mod.attempts, ShouldEqual, 1)
+		})
+
+		Convey("Stops waiting once the context is done", func() {
+			retry.InitialBackoff = time.Hour
+			retry.MaxBackoff = time.Hour
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+
+			err := retry.DeliverContext(ctx, strings.NewReader("census data"))
+			So(err, ShouldNotEqual, nil)
+			So(err.(*Error).Err, ShouldEqual, context.DeadlineExceeded)
+			So(mod.attempts, ShouldEqual, 1)
+		})
+
+		Convey("Backs off exponentially up to the limit", func() {
+			retry.InitialBackoff = 100 * time.Millisecond
+			retry.MaxBackoff = time.Second
+			for attempt, full := range map[int]time.Duration{
+				1: 100 * time.Millisecond,
+				2: 200 * time.Millisecond,
+				3: 400 * time.Millisecond,
+				5: time.Second,
+			} {
+				wait := retry.backoff(attempt)
+				So(wait, ShouldBeGreaterThanOrEqualTo, full/2)
+				So(wait, ShouldBeLessThanOrEqualTo, full)
+			}
+		})
+	})
+}
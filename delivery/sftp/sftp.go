@@ -5,10 +5,14 @@
 package sftp
 
 import (
+	"context"
 	"errors"
+	"github.com/maxwellhealth/emissary/delivery"
+	"github.com/maxwellhealth/emissary/internal/ctxio"
 	gosftp "github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 	"io"
+	"net"
 	"path/filepath"
 	"strings"
 )
@@ -20,37 +24,89 @@ const (
 
 type PathFunc func() string
 
+// The server turned down the credentials
+var errRefused = errors.New("Server refused the credentials")
+
+// The credentials are offered once; the auth method is only asked for them
+// again if the server turned them down, which ends the handshake with
+// errRefused.
+func offerOnce() func() error {
+	offered := false
+	return func() error {
+		if offered {
+			return errRefused
+		}
+		offered = true
+		return nil
+	}
+}
+
 type SFTP struct {
 	AuthMode   int
 	Username   string
 	PrivateKey []byte
 	Password   string
 	Host       string
-	// If path is provided, then it will be used. Otherwise it will delegate to PathFunc
+	// Checks the server's host key, e.g. ssh.FixedHostKey(key). Required. To
+	// accept any host key, which is insecure, use ssh.InsecureIgnoreHostKey().
+	HostKeyCallback ssh.HostKeyCallback
+	// If path is provided, then it will be used. Otherwise it will delegate to PathFunc.
+	// Either may contain EDL (see delivery.ResolvePath).
 	Path     string
 	PathFunc PathFunc
+
+	destination string
+}
+
+// Destination returns the URL of the file most recently delivered
+func (s *SFTP) Destination() string {
+	return s.destination
 }
 
 func (s *SFTP) Deliver(r io.Reader) error {
-	client, err := s.getSSHClient()
+	return s.DeliverContext(context.Background(), r)
+}
+
+// DeliverContext is the same as Deliver, but gives up once ctx is done. The
+// context's deadline applies to dialing as well as to the upload itself.
+func (s *SFTP) DeliverContext(ctx context.Context, r io.Reader) error {
+	err := s.deliver(ctx, r)
+	if err != nil && ctx.Err() != nil {
+		// Whatever broke, it broke because we gave up
+		return ctx.Err()
+	}
+	return err
+}
+
+func (s *SFTP) deliver(ctx context.Context, r io.Reader) error {
+	client, err := s.getSSHClient(ctx)
 
 	if err != nil {
 		return err
 	}
+	defer client.Close()
+
+	// Closing the client unblocks anything still waiting on the server
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.Close()
+		case <-finished:
+		}
+	}()
 
 	sftpclient, err := gosftp.NewClient(client)
 	if err != nil {
 		return err
 	}
+	defer sftpclient.Close()
 
-	var path string
 	// Determine the path
-	if len(s.Path) > 0 {
-		path = s.Path
-	} else if s.PathFunc != nil {
-		path = s.PathFunc()
-	} else {
-		return errors.New("Missing path and path func")
+	path, err := delivery.ResolvePath(ctx, s.Path, s.PathFunc)
+	if err != nil {
+		return err
 	}
 
 	// Create the path if necessary...
@@ -79,7 +135,7 @@ func (s *SFTP) Deliver(r io.Reader) error {
 
 			} else {
 				if !info.IsDir() {
-					return errors.New("Parent path exists but it is not a directory!")
+					return delivery.Permanent(errors.New("Parent path exists but it is not a directory!"))
 				}
 			}
 		}
@@ -90,39 +146,80 @@ func (s *SFTP) Deliver(r io.Reader) error {
 		return err
 	}
 
-	_, err = io.Copy(file, r)
+	_, err = io.Copy(file, ctxio.NewReader(ctx, r))
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
 
-	return err
+	s.destination = "sftp://" + s.Host + "/" + strings.TrimPrefix(path, "/")
+	return nil
 }
 
-func (s *SFTP) getSSHClient() (*ssh.Client, error) {
+func (s *SFTP) getSSHClient(ctx context.Context) (*ssh.Client, error) {
+	if s.HostKeyCallback == nil {
+		return &ssh.Client{}, delivery.Permanent(errors.New("HostKeyCallback is required (use ssh.InsecureIgnoreHostKey() to accept any host key)"))
+	}
 	conf := &ssh.ClientConfig{
-		User: s.Username,
+		User:            s.Username,
+		HostKeyCallback: s.HostKeyCallback,
 	}
+	offer := offerOnce()
 	switch s.AuthMode {
 	case AUTH_MODE_KEY:
 		if len(s.PrivateKey) == 0 {
-			return &ssh.Client{}, errors.New("Missing private key for key-based authentication")
+			return &ssh.Client{}, delivery.Permanent(errors.New("Missing private key for key-based authentication"))
 		}
 
 		key, err := ssh.ParsePrivateKey(s.PrivateKey)
 		if err != nil {
-			return &ssh.Client{}, err
+			return &ssh.Client{}, delivery.Permanent(err)
 		}
 
 		conf.Auth = []ssh.AuthMethod{
-			ssh.PublicKeys(key),
+			ssh.RetryableAuthMethod(ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+				return []ssh.Signer{key}, offer()
+			}), 2),
 		}
 	case AUTH_MODE_PASSWORD:
 		if len(s.Password) == 0 {
-			return &ssh.Client{}, errors.New("Password is required for password-based authentication")
+			return &ssh.Client{}, delivery.Permanent(errors.New("Password is required for password-based authentication"))
 		}
 		conf.Auth = []ssh.AuthMethod{
-			ssh.Password(s.Password),
+			ssh.RetryableAuthMethod(ssh.PasswordCallback(func() (string, error) {
+				return s.Password, offer()
+			}), 2),
 		}
 	default:
-		return &ssh.Client{}, errors.New("Unknown auth mode")
+		return &ssh.Client{}, delivery.Permanent(errors.New("Unknown auth mode"))
+	}
+
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", s.Host)
+	if err != nil {
+		return &ssh.Client{}, err
+	}
+
+	// The deadline covers the handshake and the upload after it
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, s.Host, conf)
+	if err != nil {
+		conn.Close()
+		if errors.Is(err, errRefused) {
+			// The server turned down the credentials, which trying again
+			// won't fix
+			return &ssh.Client{}, delivery.Permanent(err)
+		}
+		return &ssh.Client{}, err
 	}
 
-	return ssh.Dial("tcp", s.Host, conf)
+	return ssh.NewClient(c, chans, reqs), nil
 }
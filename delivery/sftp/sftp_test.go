@@ -0,0 +1,172 @@
+package sftp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"github.com/maxwellhealth/emissary/delivery"
+	"github.com/maxwellhealth/emissary/delivery/retry"
+	gosftp "github.com/pkg/sftp"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// SSH server that turns down every password, counting the connections
+func refusingServer() (net.Listener, *int32) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := ssh.NewSignerFromKey(key)
+	conf := &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+			return nil, errors.New("wrong password")
+		},
+	}
+	conf.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	var connections int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&connections, 1)
+			go func() {
+				defer conn.Close()
+				ssh.NewServerConn(conn, conf)
+			}()
+		}
+	}()
+	return listener, &connections
+}
+
+// SFTP server that takes any password and keeps files in memory. Closes
+// done once the client hangs up.
+func acceptingServer() (net.Listener, chan struct{}) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := ssh.NewSignerFromKey(key)
+	conf := &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	conf.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer close(done)
+		defer conn.Close()
+
+		server, chans, reqs, err := ssh.NewServerConn(conn, conf)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		go func() {
+			for newChannel := range chans {
+				channel, requests, err := newChannel.Accept()
+				if err != nil {
+					continue
+				}
+				go func() {
+					for req := range requests {
+						req.Reply(req.Type == "subsystem", nil)
+						if req.Type == "subsystem" {
+							go func() {
+								gosftp.NewRequestServer(channel, gosftp.InMemHandler()).Serve()
+								channel.Close()
+							}()
+						}
+					}
+				}()
+			}
+		}()
+		server.Wait()
+	}()
+	return listener, done
+}
+
+func TestSFTP(t *testing.T) {
+	Convey("SFTP", t, func() {
+		Convey("Doesn't retry when the server turns down the credentials", func() {
+			listener, connections := refusingServer()
+			defer listener.Close()
+
+			mod := &retry.Retry{
+				Module: &SFTP{
+					AuthMode: AUTH_MODE_PASSWORD,
+					Username: "jane",
+					Password: "wrong",
+					Host:     listener.Addr().String(),
+					Path:     "out.csv",
+
+					HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+				},
+				InitialBackoff: time.Millisecond,
+			}
+			err := mod.Deliver(strings.NewReader("a,b,c"))
+			So(err, ShouldNotEqual, nil)
+			So(delivery.IsPermanent(err), ShouldBeTrue)
+			So(atomic.LoadInt32(connections), ShouldEqual, 1)
+		})
+
+		Convey("Needs to be told how to check the host key", func() {
+			listener, connections := refusingServer()
+			defer listener.Close()
+
+			mod := &SFTP{
+				AuthMode: AUTH_MODE_PASSWORD,
+				Username: "jane",
+				Password: "right",
+				Host:     listener.Addr().String(),
+				Path:     "out.csv",
+			}
+			err := mod.Deliver(strings.NewReader("a,b,c"))
+			So(err, ShouldNotEqual, nil)
+			So(delivery.IsPermanent(err), ShouldBeTrue)
+			So(atomic.LoadInt32(connections), ShouldEqual, 0)
+		})
+
+		Convey("Hangs up once the file is delivered", func() {
+			listener, done := acceptingServer()
+			defer listener.Close()
+
+			mod := &SFTP{
+				AuthMode: AUTH_MODE_PASSWORD,
+				Username: "jane",
+				Password: "right",
+				Host:     listener.Addr().String(),
+				Path:     "out.csv",
+
+				HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			}
+			err := mod.Deliver(strings.NewReader("a,b,c"))
+			So(err, ShouldEqual, nil)
+			So(mod.Destination(), ShouldEqual, "sftp://"+listener.Addr().String()+"/out.csv")
+
+			hungUp := false
+			select {
+			case <-done:
+				hungUp = true
+			case <-time.After(2 * time.Second):
+			}
+			So(hungUp, ShouldBeTrue)
+		})
+	})
+}
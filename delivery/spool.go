@@ -0,0 +1,30 @@
+package delivery
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Spool copies r into a temporary file and rewinds it, for delivery modules
+// that need a seekable input or need to read the data more than once. The
+// caller is responsible for closing and removing the file.
+func Spool(r io.Reader) (*os.File, error) {
+	file, err := ioutil.TempFile("", "emissary-spool")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.Copy(file, r)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	return file, nil
+}
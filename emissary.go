@@ -1,14 +1,24 @@
 package emissary
 
 import (
-	"bytes"
-	"github.com/gorhill/cronexpr"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/maxwellhealth/emissary/delivery"
 	"github.com/maxwellhealth/emissary/generator"
 	"github.com/maxwellhealth/emissary/middleware"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrCancelled is returned to a stage whose input or output was shut down
+// because another stage of the same run failed.
+var ErrCancelled = errors.New("emissary: run cancelled by failure in another stage")
+
 type Emissary struct {
 	Name           string
 	DeliveryModule delivery.Module
@@ -16,51 +26,349 @@ type Emissary struct {
 	FileName       string
 	Schedules      []string
 	Generator      generator.FileGenerator
+
+	// Where the result of every run is recorded. Optional.
+	History RunStore
+
+	// IANA time zone (e.g. "America/New_York") that Schedules are read in.
+	// If empty, they're read in the location of whatever time they're
+	// compared against.
+	Location string
+
+	// If true, the output of the last middleware module is spooled to a
+	// temporary file and the delivery module reads from that file instead of
+	// the stream. Use this for delivery modules that need a seekable input.
+	SpoolDelivery bool
+
+	// What a Scheduler does when this emissary is due while a previous run
+	// is still going (see the OVERLAP constants)
+	Overlap int
+
+	// Runs started so far, for RunInfo.Sequence
+	sequence int64
+
+	// Schedules and Location as they were last parsed. Parsed expressions
+	// can't be used by two goroutines at once, so they're only used with
+	// scheduleMu held.
+	scheduleMu sync.Mutex
+	schedule   *parsedSchedules
+}
+
+// A Concurrent module (generator, middleware or delivery) keeps nothing on
+// itself during a run, so several runs can use it at once. Emissaries can only
+// run alongside themselves (OVERLAP_ALLOW) if every one of their modules is
+// Concurrent and says so.
+type Concurrent interface {
+	Concurrent() bool
+}
+
+func isConcurrent(module interface{}) bool {
+	c, ok := module.(Concurrent)
+	return ok && c.Concurrent()
+}
+
+// Whether every one of the emissary's modules is Concurrent
+func (e *Emissary) concurrent() bool {
+	if !isConcurrent(e.Generator) || !isConcurrent(e.DeliveryModule) {
+		return false
+	}
+	for _, m := range e.Middleware {
+		if !isConcurrent(m) {
+			return false
+		}
+	}
+	return true
+}
+
+// A StageError is the failure of a single stage of a run
+type StageError struct {
+	// "generator", "middleware[n]" or "delivery"
+	Stage string
+	Err   error
+}
+
+func (s *StageError) Error() string {
+	return s.Stage + ": " + s.Err.Error()
+}
+
+// A RunError holds the errors of every stage that failed during a run
+type RunError []*StageError
+
+func (r RunError) Error() string {
+	msgs := make([]string, len(r))
+	for i, err := range r {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
 }
 
+// Run streams the generated file through each middleware module and into the
+// delivery module. It is the same as RunContext with a background context.
 func (e *Emissary) Run() error {
-	generated := new(bytes.Buffer)
+	return e.RunContext(context.Background())
+}
 
-	// Generate the file
-	err := e.Generator.Generate(generated)
-	if err != nil {
-		return err
+// RunContext is the same as RunWithResult, without the result
+func (e *Emissary) RunContext(ctx context.Context) error {
+	_, err := e.RunWithResult(ctx)
+	return err
+}
+
+// RunWithResult streams the generated file through each middleware module
+// and into the delivery module, and returns a record of the run. Every stage
+// runs in its own goroutine and the stages are connected with pipes, so the
+// file is never held in memory in full.
+//
+// If a stage fails, the pipes on either side of it are closed so the rest of
+// the stages stop early, and the errors of all failed stages are returned
+// together as a RunError. If ctx is done before the run finishes, every pipe
+// is closed and ctx.Err() is returned.
+//
+// If the emissary has a History, the result is recorded there whether or not
+// the run succeeded. A run that succeeded but could not be recorded returns a
+// *HistoryError.
+func (e *Emissary) RunWithResult(ctx context.Context) (*RunResult, error) {
+	stages := len(e.Middleware) + 2
+	errs := make([]error, stages)
+
+	result := &RunResult{
+		Emissary: e.Name,
+		FileName: e.FileName,
+		Started:  time.Now(),
+		Rows:     -1,
+		Stages:   make([]StageResult, stages),
+		Sequence: int(atomic.AddInt64(&e.sequence, 1)),
 	}
 
-	// Middleware?
-	for _, m := range e.Middleware {
-		buf := new(bytes.Buffer)
-		err := m.Passthru(generated, buf)
+	// Lets the delivery module build its path from the run (see
+	// delivery.ResolvePath)
+	ctx = delivery.WithRunInfo(ctx, delivery.RunInfo{
+		Time:     result.Started,
+		Emissary: e.Name,
+		FileName: e.FileName,
+		Sequence: result.Sequence,
+	})
+
+	readers := make([]*io.PipeReader, stages-1)
+	writers := make([]*io.PipeWriter, stages-1)
+	counted := make([]countingPipe, stages-1)
+	for i := range readers {
+		readers[i], writers[i] = io.Pipe()
+		counted[i] = countingPipe{
+			r: &countingReader{r: readers[i]},
+			w: &countingWriter{w: writers[i]},
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(stages)
+
+	start := func(i int) {
+		result.Stages[i].Stage = stageName(i, stages)
+		result.Stages[i].Started = time.Now()
+	}
+
+	// Close the pipes around a stage once it has returned. On failure the
+	// neighbouring stages see ErrCancelled instead of EOF.
+	finish := func(i int, err error) {
+		result.Stages[i].Finished = time.Now()
+		errs[i] = err
+		closeErr := error(nil)
 		if err != nil {
-			return err
+			closeErr = ErrCancelled
+		}
+		if i > 0 {
+			readers[i-1].CloseWithError(closeErr)
+		}
+		if i < stages-1 {
+			writers[i].CloseWithError(closeErr)
+		}
+		wg.Done()
+	}
+
+	// Unblock every stage if the context is done first
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			for i := range readers {
+				readers[i].CloseWithError(ctx.Err())
+				writers[i].CloseWithError(ctx.Err())
+			}
+		case <-done:
+		}
+	}()
+
+	go func() {
+		start(0)
+		finish(0, generator.GenerateContext(ctx, e.Generator, counted[0].w))
+	}()
+
+	for i, m := range e.Middleware {
+		go func(i int, m middleware.Module) {
+			start(i)
+			finish(i, middleware.PassthruContext(ctx, m, counted[i-1].r, counted[i].w))
+		}(i+1, m)
+	}
+
+	go func() {
+		start(stages - 1)
+		finish(stages-1, e.deliver(ctx, counted[stages-2].r))
+	}()
+
+	wg.Wait()
+	close(done)
+	result.Finished = time.Now()
+
+	for i := range result.Stages {
+		if i > 0 {
+			result.Stages[i].BytesIn = counted[i-1].r.n
+		}
+		if i < stages-1 {
+			result.Stages[i].BytesOut = counted[i].w.n
+		}
+		if errs[i] != nil {
+			result.Stages[i].Error = errs[i].Error()
+		}
+	}
+
+	if counter, ok := e.Generator.(generator.RowCounter); ok && errs[0] == nil {
+		result.Rows = counter.RowCount()
+	}
+	if describer, ok := e.DeliveryModule.(delivery.Describer); ok && errs[stages-1] == nil {
+		result.Destination = describer.Destination()
+	}
+
+	err := stageErrors(errs, ctx.Err())
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	if e.History != nil {
+		recordErr := e.History.Record(result)
+		if recordErr != nil && err == nil {
+			err = &HistoryError{recordErr}
 		}
+	}
 
-		generated = buf
+	return result, err
+}
 
+func (e *Emissary) deliver(ctx context.Context, r io.Reader) error {
+	if !e.SpoolDelivery {
+		return delivery.DeliverContext(ctx, e.DeliveryModule, r)
 	}
 
-	err = e.DeliveryModule.Deliver(generated)
+	spool, err := delivery.Spool(r)
 	if err != nil {
 		return err
 	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	return delivery.DeliverContext(ctx, e.DeliveryModule, spool)
+}
+
+// Builds a RunError from the per-stage errors of a run. Stages that only
+// failed because another stage cancelled them are left out, so the error
+// points at the stage that actually went wrong. If nothing else went wrong
+// and the run's context was done, the context's error is returned as is
+// (stages blocked on a pipe when the context finished see io.ErrClosedPipe).
+func stageErrors(errs []error, ctxErr error) error {
+	var all, failed RunError
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+
+		stageErr := &StageError{stageName(i, len(errs)), err}
+		all = append(all, stageErr)
+		if err != ErrCancelled && !(ctxErr != nil && (err == ctxErr || err == io.ErrClosedPipe)) {
+			failed = append(failed, stageErr)
+		}
+	}
 
-	return nil
+	if len(all) == 0 {
+		return nil
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	if ctxErr != nil {
+		return ctxErr
+	}
+	return all
+}
 
+func stageName(i int, stages int) string {
+	switch i {
+	case 0:
+		return "generator"
+	case stages - 1:
+		return "delivery"
+	default:
+		return fmt.Sprintf("middleware[%d]", i-1)
+	}
 }
 
 func (e *Emissary) ShouldRun(t time.Time) (bool, error) {
 	t = t.Truncate(time.Minute)
 	compare := t.Add(-1 * time.Nanosecond)
 
-	for _, s := range e.Schedules {
-		parsed, err := cronexpr.Parse(s)
-		if err != nil {
-			return false, err
-		}
-		next := parsed.Next(compare)
-		if next == t {
-			return true, nil
+	next, err := e.Next(compare)
+	if err != nil {
+		return false, err
+	}
+	return next.Equal(t), nil
+}
+
+// Next returns the earliest time after t at which any of the emissary's
+// schedules fire, or the zero time if none of them fire again. See
+// nextInLocation for how daylight saving transitions are handled.
+func (e *Emissary) Next(t time.Time) (time.Time, error) {
+	e.scheduleMu.Lock()
+	defer e.scheduleMu.Unlock()
+
+	p, err := e.parsedSchedules()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return p.next(t), nil
+}
+
+// Returns the emissary's schedules, parsing them again if Schedules or
+// Location changed since they were last parsed. Must be called with
+// scheduleMu held.
+func (e *Emissary) parsedSchedules() (*parsedSchedules, error) {
+	if e.schedule != nil && e.schedule.current(e) {
+		return e.schedule, nil
+	}
+	p, err := parseSchedules(e.Schedules, e.Location)
+	if err != nil {
+		return nil, err
+	}
+	e.schedule = p
+	return p, nil
+}
+
+// MissedRuns returns every time after since and before until at which any of
+// the emissary's schedules fire, in order.
+func (e *Emissary) MissedRuns(since time.Time, until time.Time) ([]time.Time, error) {
+	e.scheduleMu.Lock()
+	defer e.scheduleMu.Unlock()
+
+	p, err := e.parsedSchedules()
+	if err != nil {
+		return nil, err
+	}
+
+	var missed []time.Time
+	for t := since; ; {
+		next := p.next(t)
+		if next.IsZero() || !next.Before(until) {
+			return missed, nil
 		}
+		missed = append(missed, next)
+		t = next
 	}
-	return false, nil
 }
@@ -1,14 +1,97 @@
 package emissary
 
 import (
+	"context"
+	"errors"
+	"github.com/maxwellhealth/emissary/data"
 	"github.com/maxwellhealth/emissary/delivery"
 	"github.com/maxwellhealth/emissary/generator"
+	"github.com/maxwellhealth/emissary/generator/spreadsheet"
 	"github.com/maxwellhealth/emissary/middleware"
 	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"sync"
 	"testing"
 	"time"
 )
 
+type failingGenerator struct {
+	err error
+}
+
+func (f *failingGenerator) Generate(w io.Writer) error {
+	_, err := w.Write([]byte("partial"))
+	if err != nil {
+		return err
+	}
+	return f.err
+}
+
+// Generator that never stops writing
+type endlessGenerator struct{}
+
+func (g *endlessGenerator) Generate(w io.Writer) error {
+	for {
+		_, err := w.Write([]byte("more data "))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Delivery module that only accepts seekable input
+type seekingDelivery struct {
+	data []byte
+}
+
+func (s *seekingDelivery) Deliver(r io.Reader) error {
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		return errors.New("input is not seekable")
+	}
+
+	_, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	_, err = seeker.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	s.data, err = ioutil.ReadAll(r)
+	return err
+}
+
+// Delivery module that gives up after reading a few bytes
+type quittingDelivery struct {
+	err error
+}
+
+func (q *quittingDelivery) Deliver(r io.Reader) error {
+	_, err := io.ReadFull(r, make([]byte, 10))
+	if err != nil {
+		return err
+	}
+	return q.err
+}
+
+// Data source that counts the rows that were read
+type countingDataSource struct {
+	read  int
+	total int
+}
+
+func (c *countingDataSource) Next() (data.Getter, error) {
+	c.read++
+	return &data.Datum{Source: map[string]interface{}{"row": c.read}}, nil
+}
+
+func (c *countingDataSource) HasNext() bool {
+	return c.read < c.total
+}
+
 func TestEmissary(t *testing.T) {
 	Convey("Emissary", t, func() {
 
@@ -31,11 +114,255 @@ func TestEmissary(t *testing.T) {
 			So(string(del.Data), ShouldEqual, "tset a si sihT")
 		})
 
+		Convey("Run with several middleware modules", func() {
+			mod.Middleware = append(mod.Middleware, &middleware.Reverse{})
+			err := mod.Run()
+			So(err, ShouldEqual, nil)
+
+			So(string(del.Data), ShouldEqual, "This is a test")
+		})
+
+		Convey("Run without middleware", func() {
+			mod.Middleware = nil
+			err := mod.Run()
+			So(err, ShouldEqual, nil)
+
+			So(string(del.Data), ShouldEqual, "This is a test")
+		})
+
+		Convey("Run stops the generator once delivery fails", func() {
+			source := &countingDataSource{total: 200000}
+			delErr := errors.New("connection reset")
+			mod.Middleware = nil
+			mod.Generator = &spreadsheet.SpreadsheetGenerator{
+				Columns:    []spreadsheet.Column{spreadsheet.Column{Value: "{{.row}}"}},
+				DataSource: source,
+			}
+			mod.DeliveryModule = &quittingDelivery{delErr}
+
+			err := mod.Run()
+			So(err, ShouldNotEqual, nil)
+			runErr := err.(RunError)
+			So(runErr[0].Err, ShouldEqual, delErr)
+			So(source.read, ShouldBeLessThan, source.total)
+		})
+
+		Convey("Run reports the failing stage", func() {
+			genErr := errors.New("data source went away")
+			mod.Generator = &failingGenerator{genErr}
+			err := mod.Run()
+			So(err, ShouldNotEqual, nil)
+
+			runErr, ok := err.(RunError)
+			So(ok, ShouldEqual, true)
+			So(len(runErr), ShouldEqual, 1)
+			So(runErr[0].Stage, ShouldEqual, "generator")
+			So(runErr[0].Err, ShouldEqual, genErr)
+			So(del.Data, ShouldBeNil)
+		})
+
+		Convey("Run with a spooled delivery", func() {
+			seeking := &seekingDelivery{}
+			mod.DeliveryModule = seeking
+
+			err := mod.Run()
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldContainSubstring, "delivery: input is not seekable")
+
+			mod.SpoolDelivery = true
+			err = mod.Run()
+			So(err, ShouldEqual, nil)
+			So(string(seeking.data), ShouldEqual, "tset a si sihT")
+		})
+
+		Convey("RunWithResult", func() {
+			history := &MemoryRunStore{}
+			mod.Name = "census"
+			mod.FileName = "census.csv"
+			mod.History = history
+
+			result, err := mod.RunWithResult(context.Background())
+			So(err, ShouldEqual, nil)
+			So(result.Succeeded(), ShouldEqual, true)
+			So(result.Emissary, ShouldEqual, "census")
+			So(result.FileName, ShouldEqual, "census.csv")
+			So(result.Rows, ShouldEqual, -1)
+			So(result.Finished.Before(result.Started), ShouldEqual, false)
+
+			So(len(result.Stages), ShouldEqual, 3)
+			So(result.Stages[0].Stage, ShouldEqual, "generator")
+			So(result.Stages[0].BytesIn, ShouldEqual, 0)
+			So(result.Stages[0].BytesOut, ShouldEqual, 14)
+			So(result.Stages[1].Stage, ShouldEqual, "middleware[0]")
+			So(result.Stages[1].BytesIn, ShouldEqual, 14)
+			So(result.Stages[1].BytesOut, ShouldEqual, 14)
+			So(result.Stages[2].Stage, ShouldEqual, "delivery")
+			So(result.Stages[2].BytesIn, ShouldEqual, 14)
+			So(result.Stages[2].BytesOut, ShouldEqual, 0)
+
+			Convey("Records every run", func() {
+				mod.Generator = &failingGenerator{errors.New("data source went away")}
+				_, err := mod.RunWithResult(context.Background())
+				So(err, ShouldNotEqual, nil)
+
+				runs, err := history.Runs("census", result.Started, time.Now())
+				So(err, ShouldEqual, nil)
+				So(len(runs), ShouldEqual, 2)
+				So(runs[0], ShouldEqual, result)
+				So(runs[1].Succeeded(), ShouldEqual, false)
+				So(runs[1].Error, ShouldEqual, "generator: data source went away")
+				So(runs[1].Stages[0].Error, ShouldEqual, "data source went away")
+			})
+		})
+
+		Convey("RunContext stops when the context is done", func() {
+			mod.Generator = &endlessGenerator{}
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			err := mod.RunContext(ctx)
+			So(err, ShouldEqual, context.DeadlineExceeded)
+			So(del.Data, ShouldBeNil)
+		})
+
+		Convey("MissedRuns", func() {
+			mod.Schedules = []string{"0 2 * * *", "30 14 * * 1"}
+			since := time.Date(2015, 4, 5, 12, 0, 0, 0, time.UTC)
+			until := time.Date(2015, 4, 7, 2, 0, 0, 0, time.UTC)
+
+			missed, err := mod.MissedRuns(since, until)
+			So(err, ShouldEqual, nil)
+			So(missed, ShouldResemble, []time.Time{
+				time.Date(2015, 4, 6, 2, 0, 0, 0, time.UTC),
+				time.Date(2015, 4, 6, 14, 30, 0, 0, time.UTC),
+			})
+		})
+
+		Convey("Parses schedules again when they change", func() {
+			mod.Schedules = []string{"0 2 * * *"}
+			from := time.Date(2015, 4, 5, 12, 0, 0, 0, time.UTC)
+
+			next, err := mod.Next(from)
+			So(err, ShouldEqual, nil)
+			So(next, ShouldResemble, time.Date(2015, 4, 6, 2, 0, 0, 0, time.UTC))
+
+			mod.Schedules[0] = "0 13 * * *"
+			next, err = mod.Next(from)
+			So(err, ShouldEqual, nil)
+			So(next, ShouldResemble, time.Date(2015, 4, 5, 13, 0, 0, 0, time.UTC))
+
+			mod.Location = "America/New_York"
+			next, err = mod.Next(from)
+			So(err, ShouldEqual, nil)
+			So(next.Equal(time.Date(2015, 4, 5, 17, 0, 0, 0, time.UTC)), ShouldEqual, true)
+
+			mod.Schedules = append(mod.Schedules, "not a schedule")
+			_, err = mod.Next(from)
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Can be asked for the next run from several goroutines at once", func() {
+			mod.Schedules = []string{"0 2 * * *", "30 14 * * 1"}
+			since := time.Date(2015, 4, 5, 12, 0, 0, 0, time.UTC)
+			until := time.Date(2015, 6, 5, 12, 0, 0, 0, time.UTC)
+
+			var wg sync.WaitGroup
+			counts := make([]int, 8)
+			for i := range counts {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					missed, _ := mod.MissedRuns(since, until)
+					counts[i] = len(missed)
+				}(i)
+			}
+			wg.Wait()
+			for _, count := range counts {
+				So(count, ShouldEqual, 61+9)
+			}
+		})
+
 		Convey("ShouldRun", func() {
 			shouldRun, err := mod.ShouldRun(time.Now())
 			So(err, ShouldEqual, nil)
 			So(shouldRun, ShouldEqual, true)
 		})
 
+		Convey("Schedules in a time zone", func() {
+			mod.Location = "America/New_York"
+			utc := func(month time.Month, day, hour, min int) time.Time {
+				return time.Date(2026, month, day, hour, min, 0, 0, time.UTC)
+			}
+
+			Convey("Follow the zone's offset through the year", func() {
+				mod.Schedules = []string{"0 6 * * *"}
+
+				next, err := mod.Next(utc(time.January, 10, 0, 0))
+				So(err, ShouldEqual, nil)
+				So(next.Equal(utc(time.January, 10, 11, 0)), ShouldEqual, true)
+
+				next, err = mod.Next(utc(time.July, 10, 0, 0))
+				So(err, ShouldEqual, nil)
+				So(next.Equal(utc(time.July, 10, 10, 0)), ShouldEqual, true)
+			})
+
+			// Clocks go from 2:00 EST to 3:00 EDT on March 8th, 2026
+			Convey("Run skipped wall times at the spring forward transition", func() {
+				mod.Schedules = []string{"30 2 * * *"}
+
+				next, err := mod.Next(utc(time.March, 7, 17, 0))
+				So(err, ShouldEqual, nil)
+				So(next.Equal(utc(time.March, 8, 7, 0)), ShouldEqual, true)
+
+				next, err = mod.Next(next)
+				So(err, ShouldEqual, nil)
+				So(next.Equal(utc(time.March, 9, 6, 30)), ShouldEqual, true)
+
+				shouldRun, err := mod.ShouldRun(utc(time.March, 8, 7, 0))
+				So(err, ShouldEqual, nil)
+				So(shouldRun, ShouldEqual, true)
+			})
+
+			Convey("Run once for the whole skipped hour", func() {
+				mod.Schedules = []string{"* * * * *"}
+
+				// 1:59 EST
+				next, err := mod.Next(utc(time.March, 8, 6, 59))
+				So(err, ShouldEqual, nil)
+				So(next.Equal(utc(time.March, 8, 7, 0)), ShouldEqual, true)
+
+				next, err = mod.Next(next)
+				So(err, ShouldEqual, nil)
+				So(next.Equal(utc(time.March, 8, 7, 1)), ShouldEqual, true)
+			})
+
+			// Clocks go from 2:00 EDT back to 1:00 EST on November 1st, 2026
+			Convey("Only run repeated wall times the first time around", func() {
+				mod.Schedules = []string{"30 1 * * *"}
+
+				next, err := mod.Next(utc(time.October, 31, 16, 0))
+				So(err, ShouldEqual, nil)
+				So(next.Equal(utc(time.November, 1, 5, 30)), ShouldEqual, true)
+
+				next, err = mod.Next(next)
+				So(err, ShouldEqual, nil)
+				So(next.Equal(utc(time.November, 2, 6, 30)), ShouldEqual, true)
+
+				shouldRun, err := mod.ShouldRun(utc(time.November, 1, 5, 30))
+				So(err, ShouldEqual, nil)
+				So(shouldRun, ShouldEqual, true)
+
+				shouldRun, err = mod.ShouldRun(utc(time.November, 1, 6, 30))
+				So(err, ShouldEqual, nil)
+				So(shouldRun, ShouldEqual, false)
+			})
+
+			Convey("Reject unknown zones", func() {
+				mod.Location = "America/Springfield"
+				_, err := mod.ShouldRun(time.Now())
+				So(err, ShouldNotEqual, nil)
+			})
+		})
+
 	})
 }
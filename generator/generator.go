@@ -1,9 +1,32 @@
 package generator
 
 import (
+	"context"
+	"github.com/maxwellhealth/emissary/internal/ctxio"
 	"io"
 )
 
 type FileGenerator interface {
 	Generate(io.Writer) error
 }
+
+// A ContextFileGenerator is a generator that can be stopped through a context
+type ContextFileGenerator interface {
+	FileGenerator
+	GenerateContext(context.Context, io.Writer) error
+}
+
+// A RowCounter is a generator that can say how many rows it wrote the last
+// time it ran
+type RowCounter interface {
+	RowCount() int
+}
+
+// GenerateContext runs g with ctx. Generators that don't implement
+// ContextFileGenerator are given a writer that fails once ctx is done.
+func GenerateContext(ctx context.Context, g FileGenerator, w io.Writer) error {
+	if cg, ok := g.(ContextFileGenerator); ok {
+		return cg.GenerateContext(ctx, w)
+	}
+	return g.Generate(ctxio.NewWriter(ctx, w))
+}
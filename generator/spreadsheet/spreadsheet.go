@@ -8,11 +8,12 @@
 package spreadsheet
 
 import (
+	"context"
 	"encoding/csv"
 	"errors"
 	"github.com/maxwellhealth/emissary/data"
-	"github.com/maxwellhealth/go-floatlist"
 	"io"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -30,6 +31,13 @@ type Column struct {
 	Default    string
 	Footer     string
 	FixedWidth int
+	// How values in this column are escaped (see the data.ESCAPE constants).
+	// By default it's up to the getter.
+	Escape int
+	// When Default is used instead of Value (see the data.DEFAULT_ON
+	// constants). By default it's up to the getter. Only getters that are
+	// data.Evaluators support it.
+	DefaultOn int
 }
 
 type SpreadsheetGenerator struct {
@@ -39,12 +47,22 @@ type SpreadsheetGenerator struct {
 	ShowColumnHeaders bool
 	ShowColumnFooters bool
 	Format            int
+	// Tables for the lookup function. Only getters that are data.Evaluators
+	// support them.
+	Lookups data.Lookups
 
 	csvWriter *csv.Writer
 	writer    io.Writer
+	rows      int
 }
 
 func (s *SpreadsheetGenerator) Generate(writer io.Writer) error {
+	return s.GenerateContext(context.Background(), writer)
+}
+
+// GenerateContext is the same as Generate, but stops before the next row once
+// ctx is done
+func (s *SpreadsheetGenerator) GenerateContext(ctx context.Context, writer io.Writer) error {
 	var csvWriter *csv.Writer
 	if s.Format != FORMAT_FIXED_WIDTH {
 		// Make the writer based on the format
@@ -61,6 +79,7 @@ func (s *SpreadsheetGenerator) Generate(writer io.Writer) error {
 
 	s.csvWriter = csvWriter
 	s.writer = writer
+	s.rows = 0
 
 	if s.ShowColumnHeaders {
 		headers := make([]string, len(s.Columns))
@@ -74,88 +93,277 @@ func (s *SpreadsheetGenerator) Generate(writer io.Writer) error {
 		}
 	}
 
-	// Figure out which columns we need to keep track of to get aggregations on the footer. The value spit out by the getter for that column must be parseable as a float for it to be added to the aggregations.
+	exprs, err := s.compile()
+	if err != nil {
+		return err
+	}
+
+	// Figure out which columns we need to keep track of to get aggregations on the footer. The value spit out by the getter for that column must be a number for it to be added to the aggregations.
 	totalRows := 0
 
-	columnsToTrack := make(map[int][]float64)
+	columnsToTrack := make(map[int]*aggregation)
 
 	for i, c := range s.Columns {
 		// If it has $sum, $mean, $median, $mode, $totalUnempty, or $totalEmpty, we need to track it so we can show it in the footer
 		if strings.Contains(c.Footer, ".mean") || strings.Contains(c.Footer, ".median") || strings.Contains(c.Footer, ".sum") || strings.Contains(c.Footer, ".mode") || strings.Contains(c.Footer, ".totalUnempty") || strings.Contains(c.Footer, ".totalEmpty") {
-			columnsToTrack[i] = []float64{}
+			columnsToTrack[i] = &aggregation{}
 		}
 	}
 
 	for s.DataSource.HasNext() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		next, err := s.DataSource.Next()
 
 		if err != nil {
 			return err
 		}
 		totalRows++
+		s.rows = totalRows
 
 		row := make([]string, len(s.Columns))
 
 		for i, c := range s.Columns {
-			val := next.Get(c.Value, c.Default)
-			row[i] = val
+			val, err := get(next, c, exprs[i])
+			if err != nil {
+				return s.cellError(totalRows, i, err)
+			}
+			row[i] = val.String()
 
 			// Do we need to keep track of it?
-			if colval, ok := columnsToTrack[i]; ok {
-				if len(val) > 0 {
-					// If it's numerical, add the number. Otherwise add 1.
-					f, err := strconv.ParseFloat(val, 64)
-					if err != nil {
-						columnsToTrack[i] = append(colval, 1.0)
-					} else {
-						columnsToTrack[i] = append(colval, f)
-					}
-				} else {
-					columnsToTrack[i] = append(colval, 0.0)
-				}
-
+			if agg, ok := columnsToTrack[i]; ok {
+				agg.add(val)
 			}
 		}
 
 		err = s.writeRow(row)
+		if err != nil {
+			return err
+		}
 	}
 
 	if s.ShowColumnFooters {
 		footer := make([]string, len(s.Columns))
-		for i, c := range s.Columns {
-			if aggregate, ok := columnsToTrack[i]; ok {
-				// Make the different aggregate values
-				list := floatlist.Floatlist(aggregate)
-				agg := &footerAggregation{
-					Sum:          list.Sum(),
-					Mean:         list.Mean(),
-					Median:       list.Median(),
-					Mode:         list.Mode(),
-					TotalUnempty: list.GetCountByValue(1.0),
-					TotalEmpty:   list.GetCountByValue(0.0),
-				}
-
+		for i := range s.Columns {
+			if agg, ok := columnsToTrack[i]; ok {
 				datum := &data.Datum{}
-				datum.SetSource(agg, "mapTo")
-				footer[i] = datum.Get(c.Footer, "")
-
+				datum.SetSource(agg.values(), "")
+				footer[i], err = datum.EvalE(exprs[i].footer, nil)
+				if err != nil {
+					return s.cellError(FOOTER_ROW, i, err)
+				}
 			} else {
 				footer[i] = ""
 			}
 		}
 
-		s.writeRow(footer)
+		return s.writeRow(footer)
 	}
 	return nil
 }
 
-type footerAggregation struct {
-	Sum          float64 `mapTo:"sum"`
-	Mean         float64 `mapTo:"mean"`
-	Median       float64 `mapTo:"median"`
-	Mode         float64 `mapTo:"mode"`
-	TotalEmpty   int     `mapTo:"totalEmpty"`
-	TotalUnempty int     `mapTo:"totalUnempty"`
+// RowCount returns the number of data rows written by the last Generate,
+// excluding the header and footer
+func (s *SpreadsheetGenerator) RowCount() int {
+	return s.rows
+}
+
+// A column's EDL, compiled once per run
+type columnExprs struct {
+	value  *data.Expr
+	def    *data.Expr
+	footer *data.Expr
+}
+
+// Returns a *CellError (with no row) for the first column with EDL that
+// doesn't parse
+func (s *SpreadsheetGenerator) compile() ([]columnExprs, error) {
+	exprs := make([]columnExprs, len(s.Columns))
+	for i, c := range s.Columns {
+		var err error
+		exprs[i].value, err = data.CompileEscaped(c.Value, c.Escape)
+		if err == nil {
+			exprs[i].value = exprs[i].value.WithDefaultOn(c.DefaultOn)
+			exprs[i].def, err = data.CompileEscaped(c.Default, c.Escape)
+		}
+		if err == nil {
+			exprs[i].footer, err = data.CompileEscaped(c.Footer, c.Escape)
+		}
+		if err != nil {
+			return nil, s.cellError(0, i, err)
+		}
+		if s.Lookups != nil {
+			exprs[i].value = exprs[i].value.WithLookups(s.Lookups)
+			exprs[i].def = exprs[i].def.WithLookups(s.Lookups)
+			exprs[i].footer = exprs[i].footer.WithLookups(s.Lookups)
+		}
+	}
+	return exprs, nil
+}
+
+// Gets the column's value, typed if the getter supports it and escaped the
+// way the column says if the getter supports that
+func get(getter data.Getter, c Column, exprs columnExprs) (data.Value, error) {
+	if evaluator, ok := getter.(data.ValueEvaluator); ok {
+		return evaluator.EvalValue(exprs.value, exprs.def)
+	}
+	if evaluator, ok := getter.(data.Evaluator); ok {
+		return stringValue(evaluator.EvalE(exprs.value, exprs.def))
+	}
+	if c.Escape != data.ESCAPE_DEFAULT {
+		if escaper, ok := getter.(data.EscapeGetter); ok {
+			return data.NewValue(escaper.GetEscaped(c.Value, c.Default, c.Escape)), nil
+		}
+	}
+	if valueGetter, ok := getter.(data.ValueGetter); ok {
+		return valueGetter.GetValue(c.Value, c.Default)
+	}
+	if errGetter, ok := getter.(data.ErrorGetter); ok {
+		return stringValue(errGetter.GetE(c.Value, c.Default))
+	}
+	return data.NewValue(getter.Get(c.Value, c.Default)), nil
+}
+
+func stringValue(val string, err error) (data.Value, error) {
+	return data.NewValue(val), err
+}
+
+// The row of a CellError that happened in the footer
+const FOOTER_ROW = -1
+
+// A CellError is EDL that failed for a particular cell
+type CellError struct {
+	// The data row, counting from 1 and not counting the header. FOOTER_ROW
+	// for the footer, or 0 if it wasn't any particular row (e.g. the EDL
+	// didn't parse).
+	Row int
+	// The column's header, or its number (from 1) if it doesn't have one
+	Column string
+	Err    error
+}
+
+func (c *CellError) Error() string {
+	msg := "column " + c.Column + ": " + c.Err.Error()
+	if c.Row == FOOTER_ROW {
+		return "footer, " + msg
+	} else if c.Row > 0 {
+		return "row " + strconv.Itoa(c.Row) + ", " + msg
+	}
+	return msg
+}
+
+func (c *CellError) Unwrap() error {
+	return c.Err
+}
+
+func (s *SpreadsheetGenerator) cellError(row int, column int, err error) *CellError {
+	name := strconv.Itoa(column + 1)
+	if header := s.Columns[column].Header; len(header) > 0 {
+		name = "'" + header + "'"
+	}
+	return &CellError{row, name, err}
+}
+
+// The values of a column, for the footer
+type aggregation struct {
+	numbers  []data.Decimal
+	empty    int
+	notEmpty int
+}
+
+// Numbers (and strings that are numbers) are added as they are. Anything
+// else counts as 1, or 0 if it's empty.
+func (a *aggregation) add(val data.Value) {
+	if len(val.String()) == 0 {
+		a.empty++
+		a.numbers = append(a.numbers, data.Decimal{})
+		return
+	}
+
+	a.notEmpty++
+	d, err := val.Decimal()
+	if err != nil {
+		d = data.NewDecimal(1, 0)
+	}
+	a.numbers = append(a.numbers, d)
+}
+
+func (a *aggregation) values() map[string]interface{} {
+	sum := data.Decimal{}
+	for _, d := range a.numbers {
+		sum = sum.Add(d)
+	}
+
+	var mean, median, mode data.Decimal
+	if count := len(a.numbers); count > 0 {
+		mean, _ = sum.Div(data.NewDecimal(int64(count), 0), data.DefaultDecimalCount, data.DefaultRounding)
+
+		// The lower of the middle two when there's an even number
+		sorted := append([]data.Decimal(nil), a.numbers...)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return sorted[i].Cmp(sorted[j]) < 0
+		})
+		median = sorted[(count-1)/2]
+
+		// The first to turn up most often
+		counts := make(map[string]int)
+		best := 0
+		for _, d := range a.numbers {
+			key := d.String()
+			counts[key]++
+			if counts[key] > best {
+				mode, best = d, counts[key]
+			}
+		}
+	}
+
+	return map[string]interface{}{
+		"sum":          sum,
+		"mean":         mean,
+		"median":       median,
+		"mode":         mode,
+		"totalEmpty":   a.empty,
+		"totalUnempty": a.notEmpty,
+	}
+}
+
+// What footers can refer to
+var footerSchema = data.Fields("sum", "mean", "median", "mode", "totalEmpty", "totalUnempty")
+
+// A Diagnostic is a problem Validate found in a column's EDL
+type Diagnostic struct {
+	// As for CellError
+	Column string
+	// "Value", "Default" or "Footer"
+	Field string
+	data.Diagnostic
+}
+
+func (d Diagnostic) String() string {
+	return "column " + d.Column + " " + d.Field + ", " + d.Diagnostic.String()
+}
+
+// Validate checks the EDL of every column (see data.Validate). Values and
+// defaults are checked against the schemas, if any are given, and footers
+// against the aggregations that are available to them. Returns nothing if
+// the configuration is fine.
+func (s *SpreadsheetGenerator) Validate(schema ...data.Schema) []Diagnostic {
+	var diagnostics []Diagnostic
+	add := func(column int, field string, found []data.Diagnostic) {
+		name := s.cellError(0, column, nil).Column
+		for _, d := range found {
+			diagnostics = append(diagnostics, Diagnostic{name, field, d})
+		}
+	}
+
+	for i, c := range s.Columns {
+		add(i, "Value", data.Validate(c.Value, schema...))
+		add(i, "Default", data.Validate(c.Default, schema...))
+		add(i, "Footer", data.Validate(c.Footer, footerSchema))
+	}
+	return diagnostics
 }
 
 func (s *SpreadsheetGenerator) writeRow(row []string) error {
@@ -190,6 +398,10 @@ func (s *SpreadsheetGenerator) writeRow(row []string) error {
 			return err
 		}
 		s.csvWriter.Flush()
+		err = s.csvWriter.Error()
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -1,9 +1,12 @@
 package spreadsheet
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"github.com/maxwellhealth/emissary/data"
 	. "github.com/smartystreets/goconvey/convey"
+	"strings"
 	"testing"
 	// "time"
 )
@@ -17,7 +20,7 @@ func (t *testDataSource) Next() (data.Getter, error) {
 	if t.index >= len(t.data) {
 		return &data.Datum{}, errors.New("No data remaining")
 	}
-	ret := &data.Datum{t.data[t.index]}
+	ret := &data.Datum{Source: t.data[t.index]}
 	t.index++
 	return ret, nil
 }
@@ -82,6 +85,7 @@ func TestSpreadsheet(t *testing.T) {
 			So(err, ShouldEqual, nil)
 
 			So(string(writer.data), ShouldEqual, "th,15,\"this has a , comma\"\nfo,20,bar\n")
+			So(s.RowCount(), ShouldEqual, 2)
 		})
 
 		Convey("TSV", func() {
@@ -107,6 +111,122 @@ func TestSpreadsheet(t *testing.T) {
 			So(string(writer.data), ShouldEqual, "th   15 th\nfo   20 ba\n")
 		})
 
+		Convey("Escapes the way the column says", func() {
+			s.DataSource = dataSourceFromSlice([]map[string]interface{}{
+				map[string]interface{}{
+					"a": "AT&T",
+					"b": "=HYPERLINK(\"http://example.com\")",
+					"c": -5,
+				},
+			})
+			s.Columns[0].Value = "{{.a}}"
+			s.Columns[1].Value = "{{.c}}"
+			s.Columns[1].Escape = data.ESCAPE_CSV
+			s.Columns[2].Escape = data.ESCAPE_CSV
+
+			err := s.Generate(writer)
+			So(err, ShouldEqual, nil)
+			So(string(writer.data), ShouldEqual, "AT&T,-5,\"'=HYPERLINK(\"\"http://example.com\"\")\"\n")
+		})
+
+		Convey("Falls back to the column's default", func() {
+			s.Columns[0].Value = "{{.missing}}"
+			s.Columns[0].Default = "{{.c}} missing"
+			s.Columns[2].Value = "b: {{.missing}}"
+			s.Columns[2].Default = "none"
+			s.Columns[2].DefaultOn = data.DEFAULT_ON_EMPTY
+			err := s.Generate(writer)
+			So(err, ShouldEqual, nil)
+			So(string(writer.data), ShouldEqual, "5 missing,15,b: \n10 missing,20,b: \n")
+		})
+
+		Convey("Looks up values in its tables", func() {
+			s.Lookups = data.Lookups{"codes": {"5": "low"}}
+			s.Columns[1].Value = `{{lookup "codes" .c}}`
+			s.Columns[1].Default = `{{lookup "codes" 5}}`
+			s.Columns[1].DefaultOn = data.DEFAULT_ON_EMPTY
+			err := s.Generate(writer)
+			So(err, ShouldEqual, nil)
+			So(string(writer.data), ShouldEqual, "th,low,\"this has a , comma\"\nfo,low,bar\n")
+		})
+
+		Convey("Reports the cell that failed", func() {
+			s.Columns[1].Header = "Salary"
+			s.Columns[1].Value = "{{if (gt .a 9)}}big{{end}}"
+			err := s.Generate(writer)
+			So(err, ShouldNotEqual, nil)
+			So(err.(*CellError).Row, ShouldEqual, 1)
+			So(err.Error(), ShouldStartWith, "row 1, column 'Salary': EDL error in")
+			So(errors.As(err, new(*data.EvalError)), ShouldEqual, true)
+		})
+
+		Convey("Reports EDL that doesn't parse before writing anything", func() {
+			s.Columns[2].Footer = "{{.sum"
+			err := s.Generate(writer)
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldStartWith, "column 3: EDL error in")
+			So(len(writer.data), ShouldEqual, 0)
+		})
+
+		Convey("Validates its configuration", func() {
+			So(s.Validate(data.Fields("a", "b", "c")), ShouldBeEmpty)
+
+			s.Columns[0].Header = "Name"
+			s.Columns[0].Default = "{{.nmae}}"
+			s.Columns[2].Value = "{{substring .b}}"
+			s.Columns[2].Footer = "{{.total}}"
+			diagnostics := s.Validate(data.Fields("a", "b", "c"))
+			So(len(diagnostics), ShouldEqual, 3)
+			So(diagnostics[0].String(), ShouldEqual, "column 'Name' Default, 1:3: Unknown field .nmae")
+			So(diagnostics[1].String(), ShouldEqual, "column 3 Value, 1:3: substring takes 2 arguments, not 1")
+			So(diagnostics[2].Field, ShouldEqual, "Footer")
+		})
+
+		Convey("Stops once the context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			err := s.GenerateContext(ctx, writer)
+			So(err, ShouldEqual, context.Canceled)
+			So(len(writer.data), ShouldEqual, 0)
+		})
+
+		Convey("Adds up footers exactly", func() {
+			rows := make([]map[string]interface{}, 1000)
+			for i := range rows {
+				rows[i] = map[string]interface{}{"premium": 0.1, "plan": ""}
+			}
+			rows[0]["plan"] = "PPO"
+			rows[1]["plan"] = "HMO"
+			s.DataSource = dataSourceFromSlice(rows)
+			s.Columns = []Column{
+				Column{Value: "{{.premium}}", Footer: "{{.sum}} {{currency .mean}} {{.mode}}"},
+				Column{Value: "{{.plan}}", Footer: "{{.totalUnempty}} of {{add .totalUnempty .totalEmpty}}"},
+			}
+			s.ShowColumnFooters = true
+
+			err := s.Generate(writer)
+			So(err, ShouldEqual, nil)
+			lines := strings.Split(strings.TrimSpace(string(writer.data)), "\n")
+			So(lines[len(lines)-1], ShouldEqual, "100 $0.10 0.1,2 of 1000")
+		})
+
+		Convey("Aggregates values by their type", func() {
+			s.DataSource = dataSourceFromSlice([]map[string]interface{}{
+				map[string]interface{}{"premium": data.NewDecimal(10005, 3), "active": true},
+				map[string]interface{}{"premium": "2.5", "active": false},
+				map[string]interface{}{"premium": nil, "active": nil},
+			})
+			s.Columns = []Column{
+				Column{Value: "{{.premium}}", Footer: "{{.sum}} {{.totalEmpty}}"},
+				Column{Value: "{{.active}}", Footer: "{{.sum}}"},
+			}
+			s.ShowColumnFooters = true
+
+			err := s.Generate(writer)
+			So(err, ShouldEqual, nil)
+			So(string(writer.data), ShouldEqual, "10.005,true\n2.5,false\n,\n12.505 1,2\n")
+		})
+
 		Convey("With footer aggregations", func() {
 			s.Columns[1].Footer = "{{number .mean 2}} {{number .median 0}}"
 			s.ShowColumnFooters = true
@@ -117,3 +237,69 @@ func TestSpreadsheet(t *testing.T) {
 
 	})
 }
+
+// Only has Get, so every cell goes through the expression cache
+type getterOnly struct {
+	datum *data.Datum
+}
+
+func (g *getterOnly) Get(key string, defaultValue string) string {
+	return g.datum.Get(key, defaultValue)
+}
+
+type benchDataSource struct {
+	rows  int
+	datum *data.Datum
+	plain bool
+}
+
+func (b *benchDataSource) Next() (data.Getter, error) {
+	b.rows--
+	if b.plain {
+		return &getterOnly{b.datum}, nil
+	}
+	return b.datum, nil
+}
+
+func (b *benchDataSource) HasNext() bool {
+	return b.rows > 0
+}
+
+func benchmarkGenerate(b *testing.B, plain bool) {
+	datum := &data.Datum{}
+	datum.SetSource(map[string]interface{}{
+		"name":   "Jane Doe",
+		"salary": 85000.5,
+		"plan":   "PPO",
+	}, "")
+
+	columns := make([]Column, 40)
+	for i := range columns {
+		columns[i] = Column{
+			Value:   fmt.Sprintf(`{{if (gt .salary %d.5)}}{{currency .salary}}{{else}}{{substring .name 4}} {{.plan}}{{end}}`, i*1000),
+			Default: "n/a",
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := &SpreadsheetGenerator{
+			Columns:    columns,
+			DataSource: &benchDataSource{rows: 1000, datum: datum, plain: plain},
+		}
+		err := s.Generate(&sliceWriter{})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// 40 columns x 1000 rows with each column compiled once
+func BenchmarkGenerate(b *testing.B) {
+	benchmarkGenerate(b, false)
+}
+
+// 40 columns x 1000 rows with each cell looked up in the expression cache
+func BenchmarkGenerateGetter(b *testing.B) {
+	benchmarkGenerate(b, true)
+}
@@ -0,0 +1,204 @@
+package emissary
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// A RunResult is the record of a single run of an emissary
+type RunResult struct {
+	Emissary string
+	FileName string
+	Started  time.Time
+	Finished time.Time
+
+	// Counts the emissary's runs since the process started, from 1
+	Sequence int
+
+	// Rows written by the generator, or -1 if it doesn't count them (see
+	// generator.RowCounter)
+	Rows int
+
+	// One for the generator, each middleware module and the delivery module,
+	// in that order
+	Stages []StageResult
+
+	// Where the file was delivered, if the delivery module says (see
+	// delivery.Describer)
+	Destination string
+
+	// Empty if the run succeeded
+	Error string
+}
+
+func (r *RunResult) Succeeded() bool {
+	return len(r.Error) == 0
+}
+
+func (r *RunResult) Duration() time.Duration {
+	return r.Finished.Sub(r.Started)
+}
+
+// A StageResult is the record of one stage of a run. The stages of a run
+// overlap in time, since the data streams through all of them at once.
+type StageResult struct {
+	// "generator", "middleware[n]" or "delivery"
+	Stage    string
+	Started  time.Time
+	Finished time.Time
+
+	// Bytes read from the previous stage. Always zero for the generator.
+	BytesIn int64
+	// Bytes written to the next stage. Always zero for delivery.
+	BytesOut int64
+
+	// Empty if the stage succeeded
+	Error string
+}
+
+func (s *StageResult) Duration() time.Duration {
+	return s.Finished.Sub(s.Started)
+}
+
+// A HistoryError is returned from a run that succeeded but could not be
+// recorded in the emissary's History. The file was still delivered.
+type HistoryError struct {
+	Err error
+}
+
+func (h *HistoryError) Error() string {
+	return "emissary: failed to record run: " + h.Err.Error()
+}
+
+// A RunStore keeps a record of every run
+type RunStore interface {
+	Record(*RunResult) error
+	// Returns the runs of the named emissary that started between from and
+	// to, oldest first
+	Runs(name string, from time.Time, to time.Time) ([]*RunResult, error)
+}
+
+// MemoryRunStore keeps run records in memory, so they only survive as long as
+// the process. Its zero value is ready to use.
+type MemoryRunStore struct {
+	mu   sync.Mutex
+	runs []*RunResult
+}
+
+func (m *MemoryRunStore) Record(r *RunResult) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.runs = append(m.runs, r)
+	return nil
+}
+
+func (m *MemoryRunStore) Runs(name string, from time.Time, to time.Time) ([]*RunResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var runs []*RunResult
+	for _, r := range m.runs {
+		if r.Emissary == name && inRange(r.Started, from, to) {
+			runs = append(runs, r)
+		}
+	}
+	return runs, nil
+}
+
+// FileRunStore appends run records to a file on the local disk, one JSON
+// object per line. It's meant for a single process; use a database-backed
+// RunStore if several processes share a history.
+type FileRunStore struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func (f *FileRunStore) Record(r *RunResult) error {
+	encoded, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(append(encoded, '\n'))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (f *FileRunStore) Runs(name string, from time.Time, to time.Time) ([]*RunResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.Open(f.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var runs []*RunResult
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for {
+		r := &RunResult{}
+		err := decoder.Decode(r)
+		if err == io.EOF {
+			return runs, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if r.Emissary == name && inRange(r.Started, from, to) {
+			runs = append(runs, r)
+		}
+	}
+}
+
+func inRange(t time.Time, from time.Time, to time.Time) bool {
+	return !t.Before(from) && !t.After(to)
+}
+
+// Pipe ends that count the bytes going through them
+type countingPipe struct {
+	r *countingReader
+	w *countingWriter
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,56 @@
+package emissary
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileRunStore(t *testing.T) {
+	Convey("FileRunStore", t, func() {
+		dir, err := ioutil.TempDir("", "emissary-history")
+		So(err, ShouldEqual, nil)
+		defer os.RemoveAll(dir)
+
+		store := &FileRunStore{Path: filepath.Join(dir, "runs.jsonl")}
+
+		runs, err := store.Runs("census", time.Time{}, time.Now())
+		So(err, ShouldEqual, nil)
+		So(len(runs), ShouldEqual, 0)
+
+		tuesday := time.Date(2015, 4, 7, 2, 0, 0, 0, time.UTC)
+		for i := 0; i < 3; i++ {
+			err := store.Record(&RunResult{
+				Emissary:    "census",
+				Started:     tuesday.Add(time.Duration(i) * 24 * time.Hour),
+				Finished:    tuesday.Add(time.Duration(i)*24*time.Hour + time.Minute),
+				Rows:        100 + i,
+				Destination: "sftp://example.com/census.csv",
+				Stages: []StageResult{
+					StageResult{Stage: "generator", BytesOut: 2048},
+					StageResult{Stage: "delivery", BytesIn: 2048},
+				},
+			})
+			So(err, ShouldEqual, nil)
+		}
+		So(store.Record(&RunResult{Emissary: "eligibility", Started: tuesday}), ShouldEqual, nil)
+
+		// Did the file go out on Tuesday?
+		runs, err = store.Runs("census", tuesday.Truncate(24*time.Hour), tuesday.Truncate(24*time.Hour).Add(24*time.Hour-time.Nanosecond))
+		So(err, ShouldEqual, nil)
+		So(len(runs), ShouldEqual, 1)
+		So(runs[0].Succeeded(), ShouldEqual, true)
+		So(runs[0].Rows, ShouldEqual, 100)
+		So(runs[0].Duration(), ShouldEqual, time.Minute)
+		So(runs[0].Destination, ShouldEqual, "sftp://example.com/census.csv")
+		So(runs[0].Stages[1].BytesIn, ShouldEqual, 2048)
+
+		runs, err = store.Runs("census", tuesday, tuesday.Add(72*time.Hour))
+		So(err, ShouldEqual, nil)
+		So(len(runs), ShouldEqual, 3)
+		So(runs[2].Rows, ShouldEqual, 102)
+	})
+}
@@ -0,0 +1,68 @@
+// Readers and writers that stop working once a context is done. These are
+// used to adapt modules that don't accept a context, so that a cancelled run
+// stops them at their next read or write.
+
+package ctxio
+
+import (
+	"context"
+	"io"
+)
+
+type reader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+type readSeeker struct {
+	reader
+	s io.Seeker
+}
+
+func (r *readSeeker) Seek(offset int64, whence int) (int64, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.s.Seek(offset, whence)
+}
+
+// NewReader returns a reader that fails with ctx.Err() once ctx is done. If r
+// is also an io.Seeker, so is the returned reader.
+func NewReader(ctx context.Context, r io.Reader) io.Reader {
+	if ctx.Done() == nil {
+		// Can never be cancelled
+		return r
+	}
+
+	if s, ok := r.(io.Seeker); ok {
+		return &readSeeker{reader{ctx, r}, s}
+	}
+	return &reader{ctx, r}
+}
+
+type writer struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// NewWriter returns a writer that fails with ctx.Err() once ctx is done
+func NewWriter(ctx context.Context, w io.Writer) io.Writer {
+	if ctx.Done() == nil {
+		return w
+	}
+	return &writer{ctx, w}
+}
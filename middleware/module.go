@@ -1,9 +1,26 @@
 package middleware
 
 import (
+	"context"
+	"github.com/maxwellhealth/emissary/internal/ctxio"
 	"io"
 )
 
 type Module interface {
 	Passthru(io.Reader, io.Writer) error
 }
+
+// A ContextModule is a middleware module that can be stopped through a context
+type ContextModule interface {
+	Module
+	PassthruContext(context.Context, io.Reader, io.Writer) error
+}
+
+// PassthruContext runs m with ctx. Modules that don't implement ContextModule
+// are given a reader and writer that fail once ctx is done.
+func PassthruContext(ctx context.Context, m Module, r io.Reader, w io.Writer) error {
+	if cm, ok := m.(ContextModule); ok {
+		return cm.PassthruContext(ctx, r, w)
+	}
+	return m.Passthru(ctxio.NewReader(ctx, r), ctxio.NewWriter(ctx, w))
+}
@@ -12,6 +12,11 @@ type PGP struct {
 	Key []byte
 }
 
+// Concurrent is true, as PGP keeps nothing between runs
+func (p *PGP) Concurrent() bool {
+	return true
+}
+
 func (p *PGP) Passthru(r io.Reader, w io.Writer) error {
 	return gpg.Encode(p.Key, r, w)
 }
@@ -7,6 +7,11 @@ import (
 
 type Reverse struct{}
 
+// Concurrent is true, as Reverse keeps nothing between runs
+func (reverser *Reverse) Concurrent() bool {
+	return true
+}
+
 func (reverser *Reverse) Passthru(r io.Reader, w io.Writer) error {
 	in, err := ioutil.ReadAll(r)
 	if err != nil {
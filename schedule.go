@@ -0,0 +1,146 @@
+package emissary
+
+import (
+	"github.com/gorhill/cronexpr"
+	"time"
+)
+
+// An emissary's Schedules and Location, parsed
+type parsedSchedules struct {
+	// What was parsed
+	schedules []string
+	location  string
+
+	exprs []*cronexpr.Expression
+	// Nil if the schedules are read in the location of the time they're
+	// compared against
+	loc *time.Location
+}
+
+func parseSchedules(schedules []string, location string) (*parsedSchedules, error) {
+	p := &parsedSchedules{
+		schedules: append([]string(nil), schedules...),
+		location:  location,
+		exprs:     make([]*cronexpr.Expression, len(schedules)),
+	}
+	for i, s := range schedules {
+		var err error
+		p.exprs[i], err = cronexpr.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(location) > 0 {
+		var err error
+		p.loc, err = time.LoadLocation(location)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Whether the emissary's Schedules and Location are still the ones that were
+// parsed
+func (p *parsedSchedules) current(e *Emissary) bool {
+	if e.Location != p.location || len(e.Schedules) != len(p.schedules) {
+		return false
+	}
+	for i, s := range e.Schedules {
+		if s != p.schedules[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// The earliest time after t at which any of the schedules fire, or the zero
+// time if none of them fire again
+func (p *parsedSchedules) next(t time.Time) time.Time {
+	loc := p.loc
+	if loc == nil {
+		loc = t.Location()
+	}
+
+	var next time.Time
+	for _, expr := range p.exprs {
+		n := nextInLocation(expr, t, loc)
+		if !n.IsZero() && (next.IsZero() || n.Before(next)) {
+			next = n
+		}
+	}
+	return next
+}
+
+// Works out the next time after from at which expr fires, reading expr
+// against the wall clock in loc.
+//
+// Daylight saving transitions are handled as follows:
+//
+// - When the clocks go forward, wall times in the skipped hour don't exist.
+//   Anything scheduled in that hour fires once, at the moment of the
+//   transition (so a 2:30 AM job runs at 3:00 AM that night).
+// - When the clocks go back, wall times in the repeated hour happen twice.
+//   They only fire the first time around.
+func nextInLocation(expr *cronexpr.Expression, from time.Time, loc *time.Location) time.Time {
+	wall := wallClock(from, loc)
+	for {
+		wall = expr.Next(wall)
+		if wall.IsZero() {
+			return wall
+		}
+
+		t := fromWallClock(wall, loc)
+		if t.After(from) {
+			return t
+		}
+		// The wall time already happened the first time around a repeated
+		// hour, so move on to the next one
+	}
+}
+
+// Reads t's wall clock in loc and returns it as a time in UTC, which has no
+// transitions to get in the way of the cron expression.
+func wallClock(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// The reverse of wallClock. If the wall time happens twice in loc, the first
+// time is returned. If it doesn't happen at all, the moment the clocks jumped
+// over it is returned.
+func fromWallClock(wall time.Time, loc *time.Location) time.Time {
+	// The offsets in force around the wall time. A day either side is far
+	// enough to cover any transition close to it.
+	naive := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), wall.Nanosecond(), loc)
+	var first, earliest, latest time.Time
+	for _, probe := range []time.Time{naive.Add(-24 * time.Hour), naive, naive.Add(24 * time.Hour)} {
+		_, offset := probe.Zone()
+		t := wall.Add(-time.Duration(offset) * time.Second).In(loc)
+		if earliest.IsZero() || t.Before(earliest) {
+			earliest = t
+		}
+		if latest.IsZero() || t.After(latest) {
+			latest = t
+		}
+		if wallClock(t, loc).Equal(wall) && (first.IsZero() || t.Before(first)) {
+			first = t
+		}
+	}
+
+	if !first.IsZero() {
+		return first
+	}
+
+	// The wall time was skipped. The transition is somewhere between the two
+	// readings of it, so narrow down the first moment the wall clock passed it.
+	for latest.Sub(earliest) > time.Second {
+		mid := earliest.Add(latest.Sub(earliest) / 2)
+		if wallClock(mid, loc).Before(wall) {
+			earliest = mid
+		} else {
+			latest = mid
+		}
+	}
+	return latest.Truncate(time.Second)
+}
@@ -0,0 +1,452 @@
+package emissary
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// What the Scheduler does when an emissary is due while its previous run is
+// still going
+const (
+	// Don't run it this time
+	OVERLAP_SKIP = iota
+	// Run it again as soon as the previous run is done
+	OVERLAP_QUEUE
+	// Run it alongside the previous run
+	OVERLAP_ALLOW
+)
+
+// What the Scheduler does with runs that were missed while it wasn't running
+const (
+	// Forget about them
+	CATCHUP_SKIP = iota
+	// Run the emissary once to make up for all of them
+	CATCHUP_ONCE
+	// Run the emissary once for every missed run, one after another
+	CATCHUP_ALL
+)
+
+var ErrSchedulerStopped = errors.New("emissary: scheduler has been shut down")
+
+// ErrOverlapUnsafe is returned by Scheduler.Add for an emissary that allows
+// overlapping runs when not all of its modules are Concurrent
+var ErrOverlapUnsafe = errors.New("emissary: OVERLAP_ALLOW needs modules that are safe for concurrent runs")
+
+// A Scheduler runs many emissaries according to their Schedules. Due runs
+// are handed to a fixed pool of workers, so no more runs are in flight than
+// there are workers; runs that come due while every worker is busy wait their
+// turn.
+type Scheduler struct {
+	// Called with the error of every run that fails. Optional, and may be
+	// called from several workers at once.
+	OnError func(*Emissary, error)
+
+	// Where the time of each emissary's last successful run is kept. If set,
+	// the scheduler catches up on runs that were missed since then according
+	// to CatchUp when the emissary is added or the scheduler is started.
+	// Emissaries are told apart by Name, so those without one are never
+	// caught up.
+	Checkpoints CheckpointStore
+	// One of the CATCHUP constants
+	CatchUp int
+	// How far back to look for missed runs. Zero means no limit.
+	CatchUpWindow time.Duration
+
+	workers int
+
+	mu       sync.Mutex
+	jobs     []*job
+	queue    []queuedRun
+	work     *sync.Cond
+	started  bool
+	stopping bool
+
+	// Signals the loop that the jobs have changed
+	wake chan struct{}
+	stop chan struct{}
+
+	// Context of every run, cancelled if Shutdown gives up waiting
+	runCtx    context.Context
+	cancelRun context.CancelFunc
+
+	running sync.WaitGroup
+	now     func() time.Time
+}
+
+type job struct {
+	emissary *Emissary
+	next     time.Time
+
+	// Runs that are queued or running
+	active int
+	// Runs held back until the active one is done
+	pending []time.Time
+	// Guards lastRun, and keeps checkpoints from being saved out of order
+	checkpointMu sync.Mutex
+	// Scheduled time of the latest checkpoint
+	lastRun time.Time
+}
+
+// A run waiting for a worker, and the time it was scheduled for
+type queuedRun struct {
+	job *job
+	at  time.Time
+}
+
+// NewScheduler makes a scheduler with the given number of workers
+func NewScheduler(workers int) *Scheduler {
+	if workers < 1 {
+		workers = 1
+	}
+
+	s := &Scheduler{
+		workers: workers,
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		now:     time.Now,
+	}
+	s.work = sync.NewCond(&s.mu)
+	s.runCtx, s.cancelRun = context.WithCancel(context.Background())
+	return s
+}
+
+// Add registers an emissary with the scheduler. It returns an error if any
+// of the emissary's schedules can't be parsed, or if it allows overlapping
+// runs but its modules aren't safe for them (ErrOverlapUnsafe).
+func (s *Scheduler) Add(e *Emissary) error {
+	next, err := e.Next(s.now())
+	if err != nil {
+		return err
+	}
+	if e.Overlap == OVERLAP_ALLOW && !e.concurrent() {
+		return ErrOverlapUnsafe
+	}
+
+	s.mu.Lock()
+	if s.stopping {
+		s.mu.Unlock()
+		return ErrSchedulerStopped
+	}
+
+	j := &job{emissary: e, next: next}
+	s.jobs = append(s.jobs, j)
+	started := s.started
+	s.signal()
+	s.mu.Unlock()
+
+	if !started {
+		return nil
+	}
+	missed, err := s.missedRuns(j)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.catchUp(j, missed)
+	s.mu.Unlock()
+	return nil
+}
+
+// Start begins running emissaries as they come due. It returns immediately.
+func (s *Scheduler) Start() {
+	var broken []*job
+	var errs []error
+
+	s.mu.Lock()
+	if s.started || s.stopping {
+		s.mu.Unlock()
+		return
+	}
+	s.started = true
+	jobs := append([]*job(nil), s.jobs...)
+	s.mu.Unlock()
+
+	// Jobs added from here on catch up for themselves
+	missed := make([][]time.Time, len(jobs))
+	for i, j := range jobs {
+		var err error
+		missed[i], err = s.missedRuns(j)
+		if err != nil {
+			broken = append(broken, j)
+			errs = append(errs, err)
+		}
+	}
+
+	s.mu.Lock()
+	for i, j := range jobs {
+		s.catchUp(j, missed[i])
+	}
+	for i := 0; i < s.workers; i++ {
+		s.running.Add(1)
+		go s.worker()
+	}
+	go s.loop()
+	s.mu.Unlock()
+
+	for i, j := range broken {
+		s.reportError(j.emissary, errs[i])
+	}
+}
+
+// Shutdown stops the scheduler from starting any more runs, drops runs that
+// are waiting for a worker, and waits for the runs in flight to finish. If
+// ctx is done first, the in-flight runs are cancelled and ctx.Err() is
+// returned.
+func (s *Scheduler) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.stopping {
+		s.stopping = true
+		close(s.stop)
+		for _, run := range s.queue {
+			run.job.active--
+		}
+		s.queue = nil
+		for _, j := range s.jobs {
+			j.pending = nil
+		}
+		s.work.Broadcast()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		s.cancelRun()
+		return nil
+	case <-ctx.Done():
+		s.cancelRun()
+		return ctx.Err()
+	}
+}
+
+func (s *Scheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Sleeps until the next emissary is due and dispatches it
+func (s *Scheduler) loop() {
+	for {
+		s.mu.Lock()
+		var next time.Time
+		for _, j := range s.jobs {
+			if !j.next.IsZero() && (next.IsZero() || j.next.Before(next)) {
+				next = j.next
+			}
+		}
+		s.mu.Unlock()
+
+		var timer *time.Timer
+		var fire <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(next.Sub(s.now()))
+			fire = timer.C
+		}
+
+		select {
+		case <-fire:
+			s.dispatch(s.now())
+		case <-s.wake:
+		case <-s.stop:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Triggers every job that is due at t and works out when each of them is
+// due next
+func (s *Scheduler) dispatch(t time.Time) {
+	var broken []*job
+	var errs []error
+
+	s.mu.Lock()
+	for _, j := range s.jobs {
+		if j.next.IsZero() || j.next.After(t) {
+			continue
+		}
+
+		s.trigger(j, j.next)
+
+		next, err := j.emissary.Next(t)
+		if err != nil {
+			// Schedules were valid when added, so someone changed them
+			broken = append(broken, j)
+			errs = append(errs, err)
+		}
+		j.next = next
+	}
+	s.mu.Unlock()
+
+	for i, j := range broken {
+		s.reportError(j.emissary, errs[i])
+	}
+}
+
+// Applies the job's overlap policy to a run that has come due. Must be
+// called with the lock held.
+func (s *Scheduler) trigger(j *job, at time.Time) {
+	if s.stopping {
+		return
+	}
+
+	if j.active > 0 {
+		switch j.emissary.Overlap {
+		case OVERLAP_SKIP:
+			return
+		case OVERLAP_ALLOW:
+			if j.emissary.concurrent() {
+				break
+			}
+			// Its modules were changed since it was added
+			fallthrough
+		case OVERLAP_QUEUE:
+			j.pending = append(j.pending, at)
+			return
+		}
+	}
+
+	s.enqueue(j, at)
+}
+
+func (s *Scheduler) enqueue(j *job, at time.Time) {
+	j.active++
+	s.queue = append(s.queue, queuedRun{j, at})
+	s.work.Signal()
+}
+
+// Works out the runs a job missed since its last checkpoint. Reads the
+// checkpoint store, so must be called without the lock held.
+func (s *Scheduler) missedRuns(j *job) ([]time.Time, error) {
+	name := j.emissary.Name
+	if s.Checkpoints == nil || s.CatchUp == CATCHUP_SKIP || len(name) == 0 {
+		return nil, nil
+	}
+
+	j.checkpointMu.Lock()
+	last, err := s.Checkpoints.LastRun(name)
+	if err == nil && last.After(j.lastRun) {
+		j.lastRun = last
+	}
+	j.checkpointMu.Unlock()
+	if err != nil || last.IsZero() {
+		// Never ran, so there's nothing to catch up on
+		return nil, err
+	}
+
+	now := s.now()
+	if s.CatchUpWindow > 0 && last.Before(now.Add(-s.CatchUpWindow)) {
+		last = now.Add(-s.CatchUpWindow)
+	}
+
+	missed, err := j.emissary.MissedRuns(last, now)
+	if err != nil || len(missed) == 0 {
+		return nil, err
+	}
+
+	if s.CatchUp == CATCHUP_ONCE {
+		missed = missed[len(missed)-1:]
+	}
+	return missed, nil
+}
+
+// Queues up the runs a job missed. Catch-up runs always go one after
+// another, whatever the overlap policy. Must be called with the lock held.
+func (s *Scheduler) catchUp(j *job, missed []time.Time) {
+	if s.stopping {
+		return
+	}
+	for _, at := range missed {
+		if j.active > 0 {
+			j.pending = append(j.pending, at)
+		} else {
+			s.enqueue(j, at)
+		}
+	}
+}
+
+func (s *Scheduler) worker() {
+	defer s.running.Done()
+
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.stopping {
+			s.work.Wait()
+		}
+		if s.stopping {
+			s.mu.Unlock()
+			return
+		}
+		run := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		j := run.job
+		err := j.emissary.RunContext(s.runCtx)
+		if err != nil {
+			s.reportError(j.emissary, err)
+		}
+
+		// A run that only failed to make it into the history still delivered
+		// the file, so it counts
+		_, unrecorded := err.(*HistoryError)
+		succeeded := err == nil || unrecorded
+
+		// Checkpoint before the next queued run can start, so it's saved
+		// before anything the next run saves
+		if succeeded {
+			s.checkpoint(j, run.at)
+		}
+
+		s.mu.Lock()
+		j.active--
+		if len(j.pending) > 0 && !s.stopping {
+			s.enqueue(j, j.pending[0])
+			j.pending = j.pending[1:]
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Saves the time of a successful run, unless a later run has been saved
+// already (overlapping runs can finish in any order)
+func (s *Scheduler) checkpoint(j *job, at time.Time) {
+	e := j.emissary
+	if s.Checkpoints == nil || len(e.Name) == 0 {
+		return
+	}
+
+	j.checkpointMu.Lock()
+	defer j.checkpointMu.Unlock()
+	if !at.After(j.lastRun) {
+		return
+	}
+
+	err := s.Checkpoints.SetLastRun(e.Name, at)
+	if err != nil {
+		s.reportError(e, err)
+		return
+	}
+	j.lastRun = at
+}
+
+func (s *Scheduler) reportError(e *Emissary, err error) {
+	if s.OnError != nil {
+		s.OnError(e, err)
+	}
+}
@@ -0,0 +1,317 @@
+package emissary
+
+import (
+	"context"
+	"github.com/maxwellhealth/emissary/delivery"
+	"github.com/maxwellhealth/emissary/middleware"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Generator that blocks each run until it is released
+type blockingGenerator struct {
+	mu      sync.Mutex
+	runs    int
+	started chan bool
+	release chan bool
+}
+
+func newBlockingGenerator() *blockingGenerator {
+	return &blockingGenerator{
+		started: make(chan bool, 10),
+		release: make(chan bool),
+	}
+}
+
+func (b *blockingGenerator) Generate(w io.Writer) error {
+	b.mu.Lock()
+	b.runs++
+	b.mu.Unlock()
+
+	b.started <- true
+	<-b.release
+	_, err := w.Write([]byte("done"))
+	return err
+}
+
+func (b *blockingGenerator) Concurrent() bool {
+	return true
+}
+
+func (b *blockingGenerator) Runs() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.runs
+}
+
+// Waits for n runs to start, failing if they take too long
+func waitForRuns(b *blockingGenerator, n int) bool {
+	for i := 0; i < n; i++ {
+		select {
+		case <-b.started:
+		case <-time.After(2 * time.Second):
+			return false
+		}
+	}
+	return true
+}
+
+// Makes every job due at t and dispatches them
+func dueAgain(s *Scheduler, t time.Time) {
+	s.mu.Lock()
+	for _, j := range s.jobs {
+		j.next = t
+	}
+	s.mu.Unlock()
+	s.dispatch(t)
+}
+
+type discardDelivery struct{}
+
+func (d *discardDelivery) Concurrent() bool {
+	return true
+}
+
+func (d *discardDelivery) Deliver(r io.Reader) error {
+	_, err := io.Copy(ioutil.Discard, r)
+	return err
+}
+
+func TestScheduler(t *testing.T) {
+	Convey("Scheduler", t, func() {
+		gen := newBlockingGenerator()
+		mod := &Emissary{
+			DeliveryModule: &discardDelivery{},
+			Generator:      gen,
+			Schedules:      []string{"0 2 * * *"},
+		}
+
+		due := time.Date(2015, 4, 7, 2, 0, 0, 0, time.UTC)
+
+		sched := NewScheduler(2)
+		sched.now = func() time.Time {
+			return due.Add(-time.Hour)
+		}
+
+		Convey("Rejects invalid schedules", func() {
+			err := sched.Add(&Emissary{Schedules: []string{"not a schedule"}})
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Runs emissaries as they come due", func() {
+			mod.Schedules = []string{"* * * * * * *"}
+			sched.now = time.Now
+			So(sched.Add(mod), ShouldEqual, nil)
+			sched.Start()
+
+			So(waitForRuns(gen, 1), ShouldEqual, true)
+			gen.release <- true
+			So(sched.Shutdown(context.Background()), ShouldEqual, nil)
+		})
+
+		Convey("With the skip overlap policy", func() {
+			mod.Overlap = OVERLAP_SKIP
+			So(sched.Add(mod), ShouldEqual, nil)
+			sched.Start()
+
+			sched.dispatch(due)
+			So(waitForRuns(gen, 1), ShouldEqual, true)
+			dueAgain(sched, due.Add(24*time.Hour))
+
+			gen.release <- true
+			So(sched.Shutdown(context.Background()), ShouldEqual, nil)
+			So(gen.Runs(), ShouldEqual, 1)
+		})
+
+		Convey("With the queue overlap policy", func() {
+			mod.Overlap = OVERLAP_QUEUE
+			So(sched.Add(mod), ShouldEqual, nil)
+			sched.Start()
+
+			sched.dispatch(due)
+			So(waitForRuns(gen, 1), ShouldEqual, true)
+			dueAgain(sched, due.Add(24*time.Hour))
+
+			gen.release <- true
+			So(waitForRuns(gen, 1), ShouldEqual, true)
+			gen.release <- true
+			So(sched.Shutdown(context.Background()), ShouldEqual, nil)
+			So(gen.Runs(), ShouldEqual, 2)
+		})
+
+		Convey("With the allow overlap policy", func() {
+			mod.Overlap = OVERLAP_ALLOW
+			mod.Middleware = []middleware.Module{&middleware.Reverse{}}
+			So(sched.Add(mod), ShouldEqual, nil)
+			sched.Start()
+
+			sched.dispatch(due)
+			dueAgain(sched, due.Add(24*time.Hour))
+
+			// Both runs are in flight at once
+			So(waitForRuns(gen, 2), ShouldEqual, true)
+			gen.release <- true
+			gen.release <- true
+			So(sched.Shutdown(context.Background()), ShouldEqual, nil)
+			So(gen.Runs(), ShouldEqual, 2)
+		})
+
+		Convey("Refuses to allow overlap for modules that aren't safe for it", func() {
+			mod.Overlap = OVERLAP_ALLOW
+			mod.DeliveryModule = &delivery.Mock{}
+			So(sched.Add(mod), ShouldEqual, ErrOverlapUnsafe)
+
+			mod.Overlap = OVERLAP_QUEUE
+			So(sched.Add(mod), ShouldEqual, nil)
+		})
+
+		Convey("Queues overlapping runs if unsafe modules are swapped in", func() {
+			mod.Overlap = OVERLAP_ALLOW
+			So(sched.Add(mod), ShouldEqual, nil)
+			sched.Start()
+
+			sched.mu.Lock()
+			mod.DeliveryModule = &delivery.Mock{}
+			sched.mu.Unlock()
+
+			sched.dispatch(due)
+			So(waitForRuns(gen, 1), ShouldEqual, true)
+			dueAgain(sched, due.Add(24*time.Hour))
+
+			gen.release <- true
+			So(waitForRuns(gen, 1), ShouldEqual, true)
+			gen.release <- true
+			So(sched.Shutdown(context.Background()), ShouldEqual, nil)
+			So(gen.Runs(), ShouldEqual, 2)
+		})
+
+		Convey("Catching up on missed runs", func() {
+			store := &MemoryCheckpointStore{}
+			store.SetLastRun("census", due.Add(-24*time.Hour))
+
+			mod.Name = "census"
+			now := due.Add(72*time.Hour + time.Hour)
+			sched.now = func() time.Time {
+				return now
+			}
+			sched.Checkpoints = store
+
+			Convey("Skips them by default", func() {
+				So(sched.Add(mod), ShouldEqual, nil)
+				sched.Start()
+				So(sched.Shutdown(context.Background()), ShouldEqual, nil)
+				So(gen.Runs(), ShouldEqual, 0)
+			})
+
+			Convey("Runs once for all of them", func() {
+				sched.CatchUp = CATCHUP_ONCE
+				So(sched.Add(mod), ShouldEqual, nil)
+				sched.Start()
+
+				So(waitForRuns(gen, 1), ShouldEqual, true)
+				gen.release <- true
+				So(sched.Shutdown(context.Background()), ShouldEqual, nil)
+				So(gen.Runs(), ShouldEqual, 1)
+
+				last, _ := store.LastRun("census")
+				So(last, ShouldResemble, due.Add(72*time.Hour))
+			})
+
+			Convey("Runs every one of them", func() {
+				sched.CatchUp = CATCHUP_ALL
+				So(sched.Add(mod), ShouldEqual, nil)
+				sched.Start()
+
+				for i := 0; i < 4; i++ {
+					So(waitForRuns(gen, 1), ShouldEqual, true)
+					gen.release <- true
+				}
+				So(sched.Shutdown(context.Background()), ShouldEqual, nil)
+				So(gen.Runs(), ShouldEqual, 4)
+
+				last, _ := store.LastRun("census")
+				So(last, ShouldResemble, due.Add(72*time.Hour))
+			})
+
+			Convey("Only within the catch-up window", func() {
+				sched.CatchUp = CATCHUP_ALL
+				sched.CatchUpWindow = 36 * time.Hour
+				So(sched.Add(mod), ShouldEqual, nil)
+				sched.Start()
+
+				for i := 0; i < 2; i++ {
+					So(waitForRuns(gen, 1), ShouldEqual, true)
+					gen.release <- true
+				}
+				So(sched.Shutdown(context.Background()), ShouldEqual, nil)
+				So(gen.Runs(), ShouldEqual, 2)
+			})
+
+			Convey("Never moves the checkpoint backwards", func() {
+				So(sched.Add(mod), ShouldEqual, nil)
+				j := sched.jobs[0]
+
+				// Runs finishing in any order
+				var wg sync.WaitGroup
+				for i := 20; i > 0; i-- {
+					wg.Add(1)
+					go func(at time.Time) {
+						defer wg.Done()
+						sched.checkpoint(j, at)
+					}(due.Add(time.Duration(i) * time.Hour))
+				}
+				wg.Wait()
+				sched.checkpoint(j, due)
+
+				last, _ := store.LastRun("census")
+				So(last, ShouldResemble, due.Add(20*time.Hour))
+			})
+
+			Convey("Not for emissaries that never ran", func() {
+				sched.CatchUp = CATCHUP_ALL
+				mod.Name = "brand new"
+				So(sched.Add(mod), ShouldEqual, nil)
+				sched.Start()
+				So(sched.Shutdown(context.Background()), ShouldEqual, nil)
+				So(gen.Runs(), ShouldEqual, 0)
+			})
+		})
+
+		Convey("Shutdown waits for runs in flight", func() {
+			So(sched.Add(mod), ShouldEqual, nil)
+			sched.Start()
+			sched.dispatch(due)
+			So(waitForRuns(gen, 1), ShouldEqual, true)
+
+			stopped := make(chan error)
+			go func() {
+				stopped <- sched.Shutdown(context.Background())
+			}()
+
+			select {
+			case <-stopped:
+				t.Error("Shutdown returned while a run was in flight")
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			gen.release <- true
+			So(<-stopped, ShouldEqual, nil)
+		})
+
+		Convey("Shutdown gives up when its context is done", func() {
+			So(sched.Add(mod), ShouldEqual, nil)
+			sched.Start()
+			sched.dispatch(due)
+			So(waitForRuns(gen, 1), ShouldEqual, true)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			So(sched.Shutdown(ctx), ShouldEqual, context.DeadlineExceeded)
+			gen.release <- true
+		})
+	})
+}